@@ -1,14 +1,20 @@
 package modes
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"src.elv.sh/pkg/cli"
+	"src.elv.sh/pkg/cli/term"
 	"src.elv.sh/pkg/cli/tk"
 	"src.elv.sh/pkg/fsutil"
 	"src.elv.sh/pkg/store/storedefs"
@@ -19,6 +25,59 @@ import (
 // directory. It is based on the ComboBox widget.
 type Location interface {
 	tk.ComboBox
+	// JumpBack changes to the most recently accepted directory that is not the
+	// current directory, and closes the location addon. It requires the
+	// Session field of LocationSpec to be set.
+	JumpBack()
+	// AcceptInPlace changes to the selected directory without closing the
+	// location addon. The directories are then reloaded for the new working
+	// directory, including detecting the workspace it is in.
+	AcceptInPlace()
+	// ToggleMark toggles whether the selected directory is marked.
+	ToggleMark()
+	// PushMarked calls the PushDirs callback of LocationSpec with all the
+	// marked directories, in the order they were marked, and closes the
+	// location addon. It does nothing if no directory is marked.
+	PushMarked()
+	// Delete deletes the marked directories from the history, or the selected
+	// directory if none is marked. If more than
+	// LocationSpec.BulkDeleteConfirmThreshold directories are to be deleted, or
+	// one of them has a score higher than LocationSpec.DeleteConfirmScore, a
+	// confirmation is asked first. It requires the store to implement
+	// LocationDeleteStore.
+	Delete()
+	// ToggleAbsolute toggles whether paths are shown without abbreviating the
+	// home directory as ~. It does not affect filtering.
+	ToggleAbsolute()
+	// ToggleGroup collapses or expands the group the selected row belongs to.
+	// It does nothing unless directories are grouped by workspace.
+	ToggleGroup()
+	// SetAlias sets the alias of the selected directory. An empty alias
+	// removes the alias. It requires the store to implement LocationAliasStore.
+	SetAlias(alias string)
+	// ToggleFavorite toggles whether the selected directory is a favorite. It
+	// requires the store to implement LocationFavoriteStore.
+	ToggleFavorite()
+	// ToggleSticky toggles whether the selected directory is kept at the top,
+	// just below pinned directories, until the location addon is closed.
+	ToggleSticky()
+	// ZoomIn narrows the list to the directories under the selected
+	// directory, showing their paths relative to it. Zooming can be nested.
+	ZoomIn()
+	// ZoomOut undoes the last ZoomIn. It does nothing if the list is not
+	// zoomed.
+	ZoomOut()
+	// Snapshot returns a snapshot of the directories currently shown.
+	Snapshot() LocationSnapshot
+	// CycleMatcher switches to the next matcher in LocationSpec.MatcherCycle,
+	// and filters the directories again.
+	CycleMatcher()
+	// ToggleColumn shows the given column after the other columns if it is
+	// hidden, and hides it otherwise.
+	ToggleColumn(c LocationColumn)
+	// CycleColumns rotates the shown columns, so that the column after the
+	// leftmost one becomes the leftmost one.
+	CycleColumns()
 }
 
 // LocationSpec is the configuration to start the location history feature.
@@ -30,13 +89,410 @@ type LocationSpec struct {
 	// IteratePinned specifies pinned directories by calling the given function
 	// with all pinned directories.
 	IteratePinned func(func(string))
+	// Where pinned directories are placed in the list. Interleaving pinned
+	// directories has no effect if Less is set.
+	PinPlacement LocationPinPlacement
+	// If positive, only the first this many pinned directories are shown, and
+	// the number of the other ones is shown below the list. The other ones are
+	// hidden even if they are in the directory history.
+	MaxPinned int
+	// The score used for placing pinned directories that are not in the
+	// directory history among the other directories, when PinPlacement is
+	// LocationPinsInterleaved. If zero, they are placed last.
+	DefaultScore float64
 	// IterateHidden specifies hidden directories by calling the given function
 	// with all hidden directories.
 	IterateHidden func(func(string))
+	// Whether to check that the root of the workspace the working directory is
+	// in exists. If it doesn't, for example because the pattern of the
+	// workspace is stale, an error is shown and the working directory is
+	// treated as not in any workspace, so that workspace-relative directories
+	// are not changed to. The check consumes the MaxStats budget; if it is
+	// exhausted, the root is assumed to exist.
+	ValidateWorkspaceRoot bool
+	// If not empty, the name of a file with gitignore-style patterns, one per
+	// line, of directories to hide. Lines starting with # are comments, a
+	// leading ! negates a pattern, patterns containing a slash are matched
+	// against the whole path and other patterns against each component, and
+	// *, ? and ** are supported. A pattern also hides the directories under
+	// the directories it matches. Pinned directories are not affected, and a
+	// file that doesn't exist is treated as empty.
+	IgnoreFile string
 	// IterateWorksapce specifies workspace configuration.
 	IterateWorkspaces LocationWSIterator
+	// If positive and the store implements LocationRecentVisitsStore,
+	// directories are scored and sorted by the number of visits within this
+	// window instead of the scores from the store.
+	RecentWindow time.Duration
+	// If positive and the store implements LocationRecentVisitsStore,
+	// directories that have not been visited within this duration are shown
+	// dimmed.
+	DimOlderThan time.Duration
+	// Whether to show how many times each directory has been visited today as
+	// a badge. It requires the store to implement LocationRecentVisitsStore.
+	ShowTodayBadge bool
+	// Whether to show how long until each directory expires from the history,
+	// like "(expires in 3h)". It requires the store to implement
+	// LocationExpiryStore; directories that don't expire show nothing.
+	ShowTTL bool
+	// If non-empty, the directory with this path is initially selected. The
+	// first directory is selected if there is no such directory.
+	SelectPath string
+	// Whether to hide the parent of the current directory, in addition to the
+	// current directory itself.
+	HideParent bool
+	// Whether paths are compared case-insensitively when hiding directories,
+	// as is needed on case-insensitive filesystems where the store and Getwd
+	// may report the same directory with different cases. The store still
+	// receives the blacklist as is.
+	CaseInsensitiveFS bool
+	// Whether to resolve symbolic links in the working directory before using
+	// it to hide directories and find workspaces, so that it matches the
+	// canonical paths in the store. The working directory is always cleaned
+	// with filepath.Clean.
+	ResolveWdSymlinks bool
+	// Whether to only show directories in the git worktree containing the
+	// working directory, found by looking for a .git entry in the working
+	// directory and its ancestors. Pinned directories are always shown. It has
+	// no effect if the working directory is not in a git worktree.
+	GitWorktreeOnly bool
+	// Suffixes like ".bak" or "~" that mark variants of a directory. A
+	// directory whose path is that of another directory followed by one of
+	// these suffixes is merged into the latter, which gets the higher score of
+	// the two.
+	CollapseSuffixes []string
 	// Configuration for the filter.
 	Filter FilterSpec
+	// If non-nil, called with the number of matching directories every time
+	// the filter changes, including when the location mode starts.
+	OnResultCount func(count int)
+	// If non-nil, used to sort directories instead of sorting them by score in
+	// descending order. Pinned directories are still shown first, unless
+	// LessIncludesPinned is true.
+	Less func(a, b storedefs.Dir) bool
+	// Whether Less also determines the order of pinned directories among all
+	// directories.
+	LessIncludesPinned bool
+	// The order of directories when the filter is empty. Pinned directories
+	// are always shown first.
+	EmptyQueryOrder LocationOrder
+	// If positive, at most this many directories are shown, and a footer
+	// below the list shows how many are omitted, like "+127 more (refine your
+	// query)". The footer is not a row of the list, so it can't be selected,
+	// accepted or matched by the filter, and it stays visible when the list
+	// scrolls.
+	Limit int
+	// If positive, filters shorter than this many characters are ignored, and
+	// all directories are shown.
+	MinQueryLen int
+	// If non-nil, used to match the filter against directories instead of
+	// the Maker in Filter. If nil, a FilterMatcher wrapping Filter is used.
+	// Parts of paths that matched are highlighted.
+	Matcher LocationMatcher
+	// If not empty, the matchers that can be cycled through with
+	// CycleMatcher, starting from the first one; Matcher is then ignored. The
+	// name of the active matcher is shown on the right of the filter.
+	MatcherCycle []LocationMatcher
+	// If non-nil, called with the filter and the abbreviated path of each
+	// matching directory to compute a match score. When the filter is
+	// non-empty, matching directories are sorted by their match scores in
+	// descending order.
+	Rank func(filter, path string) float64
+	// Whether to show the match score computed by Rank alongside the score of
+	// each directory when the filter is non-empty. Useful for tuning Rank.
+	DebugScores bool
+	// Whether to show the percentile of the score of each directory among the
+	// matching directories, instead of the score itself.
+	ShowPercentile bool
+	// If non-nil, used to format the scores of directories other than pinned
+	// ones, instead of rounding them to integers. The score column is as wide
+	// as the widest formatted score, so that paths stay aligned.
+	ScoreFormat func(score float64) string
+	// The marker shown in place of the score of pinned directories. If empty,
+	// "*" is used. Scores are padded so that paths stay aligned.
+	PinnedMarker string
+	// Whether to group directories under headers by the kind of workspace
+	// they belong to, with directories outside any workspace grouped under
+	// "Other". Groups can be collapsed and expanded. It has no effect unless
+	// IterateWorkspaces is also set.
+	GroupByWorkspace bool
+	// Whether to show the directories most likely to be changed to next from
+	// the working directory at the top of the list, just below pinned
+	// directories, when the filter is empty. It requires the store to
+	// implement LocationNextLikelyStore.
+	SuggestNext bool
+	// Whether to group directories under headers by the mount point of the
+	// filesystem they are on, with directories whose mount point can't be
+	// determined grouped under "Other". Mount points are found from the device
+	// IDs reported by Stat on Unix, and are drives on Windows; finding them
+	// consumes the MaxStats budget. It takes precedence over GroupByWorkspace.
+	GroupByMount bool
+	// Whether to show the mount point of the filesystem each directory is on
+	// after its path, like "[/mnt/nas]". See GroupByMount for how mount points
+	// are found.
+	ShowMount bool
+	// Whether to color the paths of directories other than pinned ones by
+	// their scores relative to the highest score among the matching
+	// directories, from blue for the lowest scores to red for the highest.
+	HeatmapColoring bool
+	// Whether to show paths with dimmed path separators and the last component
+	// in bold.
+	StyledSeparators bool
+	// Whether to initially show paths without abbreviating the home directory
+	// as ~.
+	AbsoluteDisplay bool
+	// If non-nil, called in a separate goroutine with the absolute path of the
+	// selected directory to compute a preview shown below the list. The
+	// context is canceled when the selection or the filter changes, or the
+	// addon is closed; the result is then discarded.
+	Preview func(ctx context.Context, dir string) ui.Text
+	// Whether to show the number of immediate subdirectories of directories
+	// that have been selected. The number is computed in a separate goroutine
+	// when a directory is selected, and is not shown for directories that
+	// can't be read. Each directory read consumes the MaxStats budget.
+	ShowChildCount bool
+	// If non-nil, called in a separate goroutine with the absolute path of
+	// each selected directory to find whether the git repository it is in is
+	// clean, which is then shown after the path. It should return false for ok
+	// if the directory is not in a git repository. Results are cached.
+	GitStatus func(dir string) (clean bool, ok bool)
+	// Whether to mark directories that the current user likely can't enter,
+	// judging from their permission bits. This is best-effort, and each check
+	// consumes the MaxStats budget.
+	MarkInaccessible bool
+	// Whether directories that are symbolic links also match the filter when
+	// their targets do. Each symbolic link check consumes the MaxStats budget.
+	MatchSymlinkTargets bool
+	// Whether to show the targets of directories that are symbolic links after
+	// their paths, like "~/link -> /target". Each symbolic link check consumes
+	// the MaxStats budget.
+	ShowSymlinkTargets bool
+	// If non-nil, called with the absolute path of each directory to find the
+	// name of the project containing it, for example by looking for the
+	// nearest go.mod. Directories also match the filter when the names of
+	// their projects do. It is called once for each directory when the
+	// location mode starts.
+	ProjectRoot func(path string) (name string, ok bool)
+	// Whether to show the project names found by ProjectRoot after the paths,
+	// like "[elvish]".
+	ShowProject bool
+	// Columns initially shown between the score and the path of each
+	// directory, in order. Columns can be toggled and reordered while the
+	// location mode is active.
+	Columns []LocationColumn
+	// If positive and the store implements LocationRecentCommandsStore, up to
+	// this many commands most recently run in the selected directory are shown
+	// in the preview, after the output of Preview if it is also set.
+	RecentCommands int
+	// Whether to show a compact status summarizing the active non-default
+	// options on the right of the filter.
+	ShowStatus bool
+	// Whether to show compact flags for the active matcher, the order of
+	// directories when the filter is empty, and whether paths are shown
+	// absolute in the label of the prompt, like " LOCATION [substring·score] ".
+	// The matcher is omitted if neither Matcher nor MatcherCycle is set.
+	RichPrompt bool
+	// Whether to show an animated spinner on the right of the filter while
+	// any background computation, like Preview, is in progress.
+	ShowSpinner bool
+	// Keys that replace the filter with preset queries.
+	QuickFilters []LocationQuickFilter
+	// The number of rows to keep between the selected directory and the top
+	// and bottom edges of the list when possible. It is only used if
+	// HasScrollMargin is true; otherwise 2 rows are kept.
+	ScrollMargin int
+	// Whether ScrollMargin is set.
+	HasScrollMargin bool
+	// Whether to show below the list how the selected directory matched the
+	// filter: the number of matched characters, whether they are contiguous,
+	// where the match starts, and the rank given by Rank if it is set.
+	ShowMatchDetail bool
+	// Whether to animate the location mode when it opens, by growing it over a
+	// few frames. Any event ends the animation immediately.
+	OpenAnimation bool
+	// If positive, when fewer rows than this are available to the location
+	// mode, the preview, the footers and the status are not shown to leave
+	// more rows for the directories.
+	CompactBelowRows int
+	// The function used to get information about directories. If nil, os.Stat
+	// is used.
+	Stat func(string) (os.FileInfo, error)
+	// The function used to read directories. If nil, os.ReadDir is used.
+	ReadDir func(string) ([]os.DirEntry, error)
+	// The function used to read symbolic links. If nil, os.Readlink is used.
+	Readlink func(string) (string, error)
+	// The function used to resolve symbolic links when ResolveWdSymlinks is
+	// true. If nil, filepath.EvalSymlinks is used.
+	EvalSymlinks func(string) (string, error)
+	// The maximum number of times Stat is called per invocation of the
+	// location mode. All the features that need information from the
+	// filesystem share this budget, and rows that are rendered earlier consume
+	// it first; once it is exhausted, directories are shown without such
+	// information. If zero or negative, there is no limit.
+	MaxStats int
+	// If positive, information about this many directories at the top of the
+	// list is fetched in the background when the location mode starts, so
+	// that features like columns don't have to wait for it. Prefetching
+	// consumes the MaxStats budget, and stops when the addon is closed.
+	PrefetchTopN int
+	// If non-nil, used to load the initial filter when the location mode
+	// starts, and to save the filter when it is closed.
+	QueryStore LocationQueryStore
+	// If non-nil, called instead of popping the addon when the location mode
+	// is done, for example after a directory is accepted. This allows
+	// embedding the widget returned by NewLocation in a larger layout instead
+	// of pushing it as an addon; the embedder should then call its Dismiss
+	// method when it is removed.
+	Close func()
+	// If non-nil, called when the location mode is closed without accepting
+	// anything, for example with the close-mode binding. Since the mode is
+	// closed with the state of the app locked, OnCancel and OnClose are
+	// called in a separate goroutine, so that they can use the app.
+	OnCancel func()
+	// If non-nil, called when the location mode is closed, after OnCancel.
+	// The argument is whether a directory was accepted.
+	OnClose func(accepted bool)
+	// If non-nil, accepting a directory calls Pick with its absolute path
+	// instead of changing to it. This can be used to make the location mode a
+	// directory picker.
+	Pick func(dir string)
+	// If non-nil, accepting a path that is not a directory calls Open with its
+	// absolute path and information about it instead of changing to it, so
+	// that it can be handled according to its type; for example, files can be
+	// opened in an editor. Directories, and paths that can't be stat-ed, are
+	// still changed to. The information comes from Stat, which is called when
+	// accepting without consuming the MaxStats budget. Errors returned by Open
+	// are shown. Pick takes precedence.
+	Open func(path string, info os.FileInfo) error
+	// Whether accepting a path that is no longer a directory but a file
+	// changes to the directory containing the file. If false, an error is
+	// shown instead.
+	AcceptFileAsParent bool
+	// If non-nil, called after successfully changing to a directory with the
+	// equivalent shell command, like "cd /usr", so that it can be recorded in
+	// the command history.
+	OnAcceptCommand func(cmd string)
+	// If non-nil, used to quote the path in the command passed to
+	// OnAcceptCommand. If nil, the path is used as is.
+	QuotePath func(path string) string
+	// Functions called in order with the directory after successfully changing
+	// to it. If one of them returns an error, the error is shown and the rest
+	// are not called; the working directory is not changed back.
+	PostAccept []func(dir string) error
+	// If true and Store implements LocationDirRecorder, accepting a directory
+	// records the visit with RecordChdir after changing to it. Embedders that
+	// record all changes of the working directory themselves, like Elvish's
+	// editor does in its after-chdir hook, should leave this off.
+	RecordAccepted bool
+	// If true, accepting a directory never records the visit, even if
+	// RecordAccepted is set. This is for embedders that build the spec from a
+	// shared configuration but have their own recording in the cd pipeline,
+	// so that a visit is not counted twice.
+	SuppressAcceptRecording bool
+	// If positive, the selected directory is remembered for up to this many
+	// distinct filters, and selected again when the filter changes back to
+	// one of them, including the empty filter. The least recently left filter
+	// is forgotten first.
+	RememberSelections int
+	// When deleting more than this many directories at once, a confirmation
+	// is asked first. If zero, 1 is used; if negative, a confirmation is never
+	// asked.
+	BulkDeleteConfirmThreshold int
+	// If positive, a confirmation showing the score is asked first when
+	// deleting a directory whose score is higher than this, regardless of
+	// BulkDeleteConfirmThreshold.
+	DeleteConfirmScore float64
+	// If non-nil, called by PushMarked with the absolute paths of the marked
+	// directories, which can be used to build a directory stack.
+	PushDirs func([]string)
+	// Session keeps state that persists across different invocations of the
+	// location mode. If nil, such state is not kept.
+	Session *LocationSession
+	// If positive and Session is non-nil, the directories from the store are
+	// cached in the session, and reused by later invocations within this long
+	// with the same working directory and hidden directories. The cache is
+	// discarded when a directory is changed to or deleted from the location
+	// mode; other changes to the store should be signaled with
+	// LocationSession.Invalidate.
+	CacheTTL time.Duration
+}
+
+// LocationSession keeps state of the location mode that lives as long as the
+// session, independent of the directory history store. The zero value is ready
+// to use.
+type LocationSession struct {
+	mutex sync.Mutex
+	// The two most recently accepted directories, most recent first.
+	accepted [2]string
+	// Directories cached because of LocationSpec.CacheTTL, the key they are
+	// cached for, and when they were cached.
+	cachedDirs []storedefs.Dir
+	cacheKey   string
+	cachedAt   time.Time
+}
+
+func (s *LocationSession) addAccepted(dir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.accepted[0] != dir {
+		s.accepted[1], s.accepted[0] = s.accepted[0], dir
+	}
+}
+
+// Returns the most recently accepted directory that is not wd, or "" if there
+// is no such directory.
+func (s *LocationSession) lastAccepted(wd string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, dir := range s.accepted {
+		if dir != "" && dir != wd {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Invalidate discards the directories cached because of LocationSpec.CacheTTL.
+// It should be called when the directory history changes.
+func (s *LocationSession) Invalidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cachedDirs, s.cacheKey, s.cachedAt = nil, "", time.Time{}
+}
+
+// Returns a copy of the cached directories if they are cached for the key and
+// were cached within the TTL.
+func (s *LocationSession) getCachedDirs(key string, ttl time.Duration) ([]storedefs.Dir, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cachedDirs == nil || s.cacheKey != key || time.Since(s.cachedAt) >= ttl {
+		return nil, false
+	}
+	return append([]storedefs.Dir{}, s.cachedDirs...), true
+}
+
+func (s *LocationSession) cacheDirs(key string, dirs []storedefs.Dir) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cachedDirs = append([]storedefs.Dir{}, dirs...)
+	s.cacheKey, s.cachedAt = key, time.Now()
+}
+
+// Returns the key the directories from the store are cached for, which
+// consists of the working directory and the sorted blacklist.
+func dirsCacheKey(wd string, blacklist map[string]struct{}) string {
+	keys := make([]string, 0, len(blacklist)+1)
+	for path := range blacklist {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	return wd + "\x00" + strings.Join(keys, "\x00")
+}
+
+// LocationQuickFilter binds a key to a preset query of the location mode.
+type LocationQuickFilter struct {
+	Key   ui.Key
+	Query string
 }
 
 // LocationStore defines the interface for interacting with the directory history.
@@ -46,24 +502,435 @@ type LocationStore interface {
 	Getwd() (string, error)
 }
 
+// LocationAliasStore is an optional interface a LocationStore can implement to
+// support aliases of directories. The filter also matches aliases, and
+// directories whose alias is exactly the filter are shown first.
+type LocationAliasStore interface {
+	Alias(dir string) (string, error)
+	SetAlias(dir, alias string) error
+}
+
+// LocationFavoriteStore is an optional interface a LocationStore can implement
+// to support favorite directories. Favorite directories are marked with a
+// star, and the filter can contain an "@fav" token to only show favorite
+// directories. Unlike pinned directories, they are not shown first.
+type LocationFavoriteStore interface {
+	IsFavorite(dir string) (bool, error)
+	SetFavorite(dir string, favorite bool) error
+}
+
+// LocationRecentVisitsStore is an optional interface a LocationStore can
+// implement to support scoring directories by recent visits.
+type LocationRecentVisitsStore interface {
+	RecentVisits(dir string, since time.Time) (int, error)
+}
+
+// LocationExpiryStore is an optional interface a LocationStore can implement
+// to report when directories expire from the history. Expiry returns the zero
+// time for directories that don't expire.
+type LocationExpiryStore interface {
+	Expiry(dir string) (time.Time, error)
+}
+
+// LocationRecentCommandsStore is an optional interface a LocationStore can
+// implement to provide the commands recently run in directories.
+type LocationRecentCommandsStore interface {
+	// RecentCommands returns up to n commands most recently run in dir, most
+	// recent first.
+	RecentCommands(dir string, n int) ([]string, error)
+}
+
+// LocationNextLikelyStore is an optional interface a LocationStore can
+// implement to suggest directories that are likely to be changed to next. The
+// store is expected to learn this from the transitions between directories it
+// has recorded.
+type LocationNextLikelyStore interface {
+	// NextLikely returns up to n directories most likely to be changed to from
+	// the given directory, most likely first.
+	NextLikely(from string, n int) ([]storedefs.Dir, error)
+}
+
+// LocationSortKeyStore is an optional interface a LocationStore can implement
+// to order directories by something other than their scores. Directories are
+// ordered by their sort keys in descending order, while their scores are still
+// shown. Pinned directories are still shown first, unless
+// LocationSpec.PinPlacement says otherwise; when pinned directories are
+// interleaved, all directories are ordered by scores instead. LocationSpec.Less
+// takes precedence.
+type LocationSortKeyStore interface {
+	// SortKey returns the sort key of a directory returned by Dirs.
+	SortKey(dir storedefs.Dir) float64
+}
+
+// LocationSelectionStore is an optional interface a LocationStore can
+// implement to learn from which directories are accepted, for example to
+// improve the scores of directories that are often accepted despite being
+// ranked low.
+type LocationSelectionStore interface {
+	// RecordSelection is called when a directory is accepted, with the filter,
+	// the path of the directory as returned by Dirs, and its position among
+	// the shown directories, starting from 0. Group headers are not counted.
+	RecordSelection(query, path string, rank int) error
+}
+
+// LocationQueryStore defines the interface for persisting the filter of the
+// location mode.
+type LocationQueryStore interface {
+	LoadQuery() string
+	SaveQuery(query string)
+}
+
+// LocationOrder specifies how directories are ordered.
+type LocationOrder int
+
+// Possible values of LocationOrder.
+const (
+	// Order by score in descending order, or by LocationSpec.Less if it is
+	// set.
+	LocationOrderByScore LocationOrder = iota
+	// Order by the time of the last visit, most recent first. It requires the
+	// store to implement LocationVisitTimesStore; directories whose last visit
+	// is unknown are shown last.
+	LocationOrderByRecency
+	// Order alphabetically by path.
+	LocationOrderAlphabetically
+)
+
+// LocationPinPlacement specifies where pinned directories are placed relative
+// to the other directories.
+type LocationPinPlacement int
+
+// Possible values of LocationPinPlacement.
+const (
+	// Place pinned directories before the other directories.
+	LocationPinsAtTop LocationPinPlacement = iota
+	// Place pinned directories among the other directories according to their
+	// scores in the store; pinned directories not in the store are placed
+	// according to LocationSpec.DefaultScore. They are still shown with the
+	// pinned marker.
+	LocationPinsInterleaved
+	// Place pinned directories after the other directories.
+	LocationPinsAtBottom
+)
+
+// LocationDirRecorder defines the interface for recording visits to
+// directories. It is implemented by storedefs.Store. A LocationStore can also
+// implement it to have visits to accepted directories recorded; see
+// LocationSpec.RecordAccepted.
+type LocationDirRecorder interface {
+	AddDir(dir string, incFactor float64) error
+}
+
+// RecordChdir records a visit to dir, which should be an absolute path. If dir
+// is in a workspace, its workspace-relative path is also recorded. It should
+// be called whenever the working directory changes, whether or not the change
+// was made from the location mode, so that all visits are recorded the same
+// way.
+func RecordChdir(store LocationDirRecorder, ws LocationWSIterator, dir string) error {
+	if err := store.AddDir(dir, 1); err != nil {
+		return err
+	}
+	if ws != nil {
+		if kind, root := ws.Parse(dir); kind != "" {
+			return store.AddDir(kind+dir[len(root):], 1)
+		}
+	}
+	return nil
+}
+
 // A special score for pinned directories.
 var pinnedScore = math.Inf(1)
 
-var errNoDirectoryHistoryStore = errors.New("no directory history store")
+var (
+	errNoDirectoryHistoryStore = errors.New("no directory history store")
+	errNoLastAccepted          = errors.New("no previously accepted directory")
+	errWSPatternTooBroad       = errors.New("pattern matches the root of the filesystem")
+)
+
+type location struct {
+	tk.ComboBox
+	app    cli.App
+	spec   LocationSpec
+	wd     string
+	wsKind string
+	wsRoot string
+	dirs   []storedefs.Dir
+	stats  *statCache
+	// Workspaces from LocationSpec.IterateWorkspaces, compiled when loading.
+	workspaces []compiledWorkspace
+	// Maps paths to the group they belong to; only non-nil when grouping by
+	// workspace.
+	groups map[string]string
+	// Maps paths to the number of visits today, if it is non-zero.
+	todayVisits map[string]int
+	// Directories not visited within LocationSpec.DimOlderThan.
+	old map[string]bool
+	// Times directories expire, when LocationSpec.ShowTTL is set.
+	expiries map[string]time.Time
+	// Names of the projects containing directories, as found by
+	// LocationSpec.ProjectRoot when loading.
+	projects map[string]string
+	// Times of the last visits, when ordering by recency.
+	lastVisits map[string]time.Time
+	// Maps directories suggested by LocationNextLikelyStore to their ranks,
+	// starting from 0.
+	suggested map[string]int
+	// The number of pinned directories not shown because of
+	// LocationSpec.MaxPinned.
+	hiddenPinned int
+
+	stateMutex sync.RWMutex
+	state      locationState
+
+	// Protects cancelWork, and ensures that results of background
+	// computations are only stored if they are not stale.
+	workMutex  sync.Mutex
+	cancelWork context.CancelFunc
+
+	// Incremented every time the list of shown directories is computed; used
+	// to detect stale snapshots. Must be accessed atomically.
+	generation int64
+
+	// Whether the compact layout is used, as determined by the last call to
+	// MaxHeight; see LocationSpec.CompactBelowRows.
+	compact bool
+
+	// Cancels prefetching; nil if prefetching is not enabled.
+	cancelPrefetch context.CancelFunc
+
+	// Whether a directory has been accepted, and whether Dismiss has been
+	// called.
+	accepted  bool
+	dismissed bool
+
+	// The filter the list was last built with, and the rows selected for
+	// previous filters, the least recently left one first; see
+	// LocationSpec.RememberSelections. Only accessed in OnFilter.
+	lastFilter string
+	selections []locationSelection
 
-// NewLocation creates a new location mode.
+	// Protects commands, a cache of recent commands run in directories.
+	commandsMutex sync.Mutex
+	commands      map[string][]string
+
+	// Protects the fields below, which track background computations in
+	// progress and animate the spinner.
+	busyMutex    sync.Mutex
+	busy         int
+	spinnerFrame int
+	stopSpinner  chan struct{}
+
+	// Protects the fields below, which track the animation when opening.
+	openMutex         sync.Mutex
+	openFrame         int
+	stopOpenAnimation chan struct{}
+}
+
+type locationState struct {
+	// Paths of marked directories, in the order they were marked.
+	marked []string
+	// Whether paths are shown without abbreviating the home directory.
+	absolute bool
+	// Groups that are collapsed. The map is replaced rather than mutated.
+	collapsed map[string]bool
+	// Aliases of directories. The map is replaced rather than mutated.
+	aliases map[string]string
+	// Favorite directories. The map is replaced rather than mutated.
+	favorites map[string]bool
+	// Preview of the selected directory.
+	preview ui.Text
+	// Number of immediate subdirectories of directories that have been
+	// selected. The map is replaced rather than mutated.
+	childCounts map[string]int
+	// Whether the git repositories of directories that have been selected are
+	// clean, as reported by LocationSpec.GitStatus. The map is replaced rather
+	// than mutated.
+	gitClean map[string]bool
+	// Columns shown between the score and the path. The slice is replaced
+	// rather than mutated.
+	columns []LocationColumn
+	// Directories kept at the top. The map is replaced rather than mutated.
+	sticky map[string]bool
+	// Directories the list has been zoomed into, the innermost one last. The
+	// slice is replaced rather than mutated.
+	zoom []string
+	// The index of the active matcher in LocationSpec.MatcherCycle.
+	matcher int
+}
+
+func (w *location) mutateState(f func(*locationState)) {
+	w.stateMutex.Lock()
+	defer w.stateMutex.Unlock()
+	f(&w.state)
+}
+
+func (w *location) copyState() locationState {
+	w.stateMutex.RLock()
+	defer w.stateMutex.RUnlock()
+	return w.state
+}
+
+// Validate checks the spec for errors that would otherwise only be notified
+// when the location mode starts, or cause options to be silently ignored: a
+// nil Store, workspace patterns that don't compile or match the root of the
+// filesystem, and options that have no
+// effect without other options or optional store interfaces. It returns the
+// first error found. Calling it is optional; NewLocation still works with a
+// spec that fails the checks other than the one for Store.
+func (cfg LocationSpec) Validate() error {
+	if cfg.Store == nil {
+		return errNoDirectoryHistoryStore
+	}
+	if cfg.IterateWorkspaces != nil {
+		fsRoot := string(filepath.Separator)
+		if wd, err := cfg.Store.Getwd(); err == nil {
+			fsRoot = filepath.VolumeName(wd) + fsRoot
+		}
+		var err error
+		cfg.IterateWorkspaces(func(kind, pattern string) bool {
+			_, err = compileWSPattern(kind, pattern, fsRoot)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, recentVisits := cfg.Store.(LocationRecentVisitsStore)
+	_, nextLikely := cfg.Store.(LocationNextLikelyStore)
+	_, expiry := cfg.Store.(LocationExpiryStore)
+	switch {
+	case cfg.GroupByWorkspace && cfg.IterateWorkspaces == nil:
+		return errors.New("GroupByWorkspace requires IterateWorkspaces")
+	case cfg.ShowProject && cfg.ProjectRoot == nil:
+		return errors.New("ShowProject requires ProjectRoot")
+	case cfg.CacheTTL > 0 && cfg.Session == nil:
+		return errors.New("CacheTTL requires Session")
+	case cfg.ShowTodayBadge && !recentVisits:
+		return errors.New("ShowTodayBadge requires the store to implement LocationRecentVisitsStore")
+	case cfg.DimOlderThan > 0 && !recentVisits:
+		return errors.New("DimOlderThan requires the store to implement LocationRecentVisitsStore")
+	case cfg.SuggestNext && !nextLikely:
+		return errors.New("SuggestNext requires the store to implement LocationNextLikelyStore")
+	case cfg.ShowTTL && !expiry:
+		return errors.New("ShowTTL requires the store to implement LocationExpiryStore")
+	}
+	return nil
+}
+
+// NewLocation creates a new location mode. The returned widget is not pushed
+// as an addon, so it can also be embedded in a larger layout; see
+// LocationSpec.Close.
 func NewLocation(app cli.App, cfg LocationSpec) (Location, error) {
 	if cfg.Store == nil {
 		return nil, errNoDirectoryHistoryStore
 	}
 
+	w := &location{app: app, spec: cfg,
+		stats: newStatCache(cfg.Stat, cfg.ReadDir, cfg.Readlink, cfg.MaxStats),
+		state: locationState{absolute: cfg.AbsoluteDisplay,
+			columns: append([]LocationColumn(nil), cfg.Columns...)}}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	var rprompt func() ui.Text
+	if cfg.ShowStatus || cfg.ShowSpinner || len(cfg.MatcherCycle) > 0 {
+		rprompt = w.rprompt
+	}
+	var query string
+	if cfg.QueryStore != nil {
+		query = cfg.QueryStore.LoadQuery()
+	}
+	w.ComboBox = tk.NewComboBox(tk.ComboBoxSpec{
+		CodeArea: tk.CodeAreaSpec{
+			Prompt:      w.prompt,
+			RPrompt:     rprompt,
+			Highlighter: cfg.Filter.Highlighter,
+			State: tk.CodeAreaState{
+				Buffer: tk.CodeBuffer{Content: query, Dot: len(query)}},
+		},
+		ListBox: tk.ListBoxSpec{
+			Bindings:        cfg.Bindings,
+			ScrollMargin:    cfg.ScrollMargin,
+			HasScrollMargin: cfg.HasScrollMargin,
+			OnSelect: func(it tk.Items, i int) {
+				if l := it.(locationList); l.isHeader(i) {
+					w.stopWork()
+				} else {
+					w.startWork(l.entries[i].Path)
+				}
+			},
+			OnAccept: func(it tk.Items, i int) {
+				if l := it.(locationList); l.isHeader(i) {
+					w.ToggleGroup()
+				} else {
+					w.recordSelection(l, i)
+					w.accept(l.entries[i].Path)
+				}
+			},
+		},
+		OnFilter: func(cb tk.ComboBox, p string) {
+			w.stopWork()
+			w.rememberSelection(cb.ListBox())
+			l := w.filter(p)
+			cb.ListBox().Reset(l, w.recallSelection(l, p))
+			w.lastFilter = normalizeQuery(p)
+			if cfg.OnResultCount != nil {
+				cfg.OnResultCount(l.count)
+			}
+		},
+	})
+	if cfg.PrefetchTopN > 0 {
+		w.prefetch(cfg.PrefetchTopN)
+	}
+	if cfg.OpenAnimation && app != nil {
+		w.startOpenAnimation()
+	}
+	if cfg.SelectPath != "" {
+		if l, ok := w.ListBox().CopyState().Items.(locationList); ok {
+			if i := l.findPath(cfg.SelectPath); i > 0 {
+				w.ListBox().Select(func(tk.ListBoxState) int { return i })
+			}
+		}
+	}
+	return w, nil
+}
+
+// NewLocationWithStore is like NewLocation, but uses the given store instead of
+// cfg.Store. The store is only used by the returned location mode, so a spec
+// can be shared between invocations that use different stores.
+func NewLocationWithStore(app cli.App, cfg LocationSpec, store LocationStore) (Location, error) {
+	cfg.Store = store
+	return NewLocation(app, cfg)
+}
+
+// Loads the directories from the store, along with the information that
+// depends on the working directory.
+func (w *location) load() error {
+	cfg := w.spec
 	dirs := []storedefs.Dir{}
 	blacklist := map[string]struct{}{}
 	wsKind, wsRoot := "", ""
 
+	hiddenPinned := 0
+	// When pinned directories are interleaved, their scores are looked up
+	// from the store instead of blacklisting them.
+	interleave := cfg.PinPlacement == LocationPinsInterleaved && cfg.Less == nil
+	var pinnedScores map[string]float64
+	if interleave {
+		pinnedScores = map[string]float64{}
+	}
 	if cfg.IteratePinned != nil {
 		cfg.IteratePinned(func(s string) {
-			blacklist[s] = struct{}{}
+			if cfg.MaxPinned > 0 && len(dirs) >= cfg.MaxPinned {
+				blacklist[s] = struct{}{}
+				hiddenPinned++
+				return
+			}
+			if interleave {
+				pinnedScores[s] = cfg.DefaultScore
+			} else {
+				blacklist[s] = struct{}{}
+			}
 			dirs = append(dirs, storedefs.Dir{Score: pinnedScore, Path: s})
 		})
 	}
@@ -71,50 +938,1331 @@ func NewLocation(app cli.App, cfg LocationSpec) (Location, error) {
 		cfg.IterateHidden(func(s string) { blacklist[s] = struct{}{} })
 	}
 	wd, err := cfg.Store.Getwd()
-	if err == nil {
+	hasWd := err == nil
+	if hasWd {
+		wd = w.canonicalWd(wd)
 		blacklist[wd] = struct{}{}
-		if cfg.IterateWorkspaces != nil {
-			wsKind, wsRoot = cfg.IterateWorkspaces.Parse(wd)
+		if cfg.HideParent {
+			blacklist[filepath.Dir(wd)] = struct{}{}
 		}
 	}
-	storedDirs, err := cfg.Store.Dirs(blacklist)
-	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+	w.workspaces = nil
+	if cfg.IterateWorkspaces != nil {
+		// Compile the patterns once, reporting invalid ones, since they are
+		// matched against every directory when grouping by workspace.
+		fsRoot := string(filepath.Separator)
+		if hasWd {
+			fsRoot = filepath.VolumeName(wd) + fsRoot
+		}
+		var errs []error
+		w.workspaces, errs = cfg.IterateWorkspaces.compile(fsRoot)
+		for _, err := range errs {
+			w.notifyError(err)
+		}
+		if hasWd {
+			wsKind, wsRoot = matchWorkspace(w.workspaces, wd)
+			if wsKind != "" && cfg.ValidateWorkspaceRoot {
+				// This consumes the budget before any row, since rows are
+				// displayed relative to the workspace root. If the budget is
+				// already exhausted, the root is assumed to be valid.
+				if r, ok := w.stats.Stat(wsRoot); ok && r.err != nil {
+					w.notifyError(fmt.Errorf("workspace %s: %v", wsKind, r.err))
+					wsKind, wsRoot = "", ""
+				}
+			}
+		}
+	}
+	useCache := cfg.CacheTTL > 0 && cfg.Session != nil
+	var cacheKey string
+	var storedDirs []storedefs.Dir
+	cached := false
+	if useCache {
+		cacheKey = dirsCacheKey(wd, blacklist)
+		storedDirs, cached = cfg.Session.getCachedDirs(cacheKey, cfg.CacheTTL)
+	}
+	if !cached {
+		storedDirs, err = cfg.Store.Dirs(blacklist)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if useCache {
+			cfg.Session.cacheDirs(cacheKey, storedDirs)
+		}
+	}
+	var foldedBlacklist map[string]struct{}
+	if cfg.CaseInsensitiveFS {
+		foldedBlacklist = make(map[string]struct{}, len(blacklist))
+		for path := range blacklist {
+			foldedBlacklist[strings.ToLower(path)] = struct{}{}
+		}
+	}
+	if rs, ok := cfg.Store.(LocationRecentVisitsStore); ok && cfg.RecentWindow > 0 {
+		scoreByRecentVisits(rs, storedDirs, time.Now().Add(-cfg.RecentWindow))
+	}
+	if ss, ok := cfg.Store.(LocationSortKeyStore); ok {
+		sortBySortKey(ss, storedDirs)
+	}
+	var ignorePatterns []ignorePattern
+	if cfg.IgnoreFile != "" {
+		var errs []error
+		ignorePatterns, errs = readIgnoreFile(cfg.IgnoreFile)
+		for _, err := range errs {
+			w.notifyError(err)
+		}
 	}
 	for _, dir := range storedDirs {
+		if _, ok := pinnedScores[dir.Path]; ok {
+			pinnedScores[dir.Path] = dir.Score
+			continue
+		}
+		if _, ok := foldedBlacklist[strings.ToLower(dir.Path)]; ok {
+			continue
+		}
+		if len(ignorePatterns) > 0 {
+			path := dir.Path
+			if !filepath.IsAbs(path) && wsKind != "" && hasPathPrefix(path, wsKind) {
+				path = wsRoot + path[len(wsKind):]
+			}
+			if ignored(ignorePatterns, path) {
+				continue
+			}
+		}
 		if filepath.IsAbs(dir.Path) {
 			dirs = append(dirs, dir)
 		} else if wsKind != "" && hasPathPrefix(dir.Path, wsKind) {
 			dirs = append(dirs, dir)
 		}
 	}
+	dirs = dedupDirs(dirs)
+	if len(cfg.CollapseSuffixes) > 0 {
+		dirs = collapseSuffixes(dirs, cfg.CollapseSuffixes)
+	}
+	if cfg.Less != nil {
+		sort.SliceStable(dirs, func(i, j int) bool {
+			a, b := dirs[i], dirs[j]
+			if !cfg.LessIncludesPinned && (a.Score == pinnedScore) != (b.Score == pinnedScore) {
+				return a.Score == pinnedScore
+			}
+			return cfg.Less(a, b)
+		})
+	}
+	switch {
+	case interleave:
+		score := func(dir storedefs.Dir) float64 {
+			if dir.Score == pinnedScore {
+				return pinnedScores[dir.Path]
+			}
+			return dir.Score
+		}
+		sort.SliceStable(dirs, func(i, j int) bool {
+			return score(dirs[i]) > score(dirs[j])
+		})
+	case cfg.PinPlacement == LocationPinsAtBottom:
+		sort.SliceStable(dirs, func(i, j int) bool {
+			return dirs[i].Score != pinnedScore && dirs[j].Score == pinnedScore
+		})
+	}
+	if cfg.GitWorktreeOnly {
+		if root := w.gitWorktreeRoot(wd); root != "" {
+			var inWorktree []storedefs.Dir
+			for _, dir := range dirs {
+				path := dir.Path
+				if !filepath.IsAbs(path) {
+					path = wsRoot + path[len(wsKind):]
+				}
+				if dir.Score == pinnedScore || hasPathPrefix(path, root) {
+					inWorktree = append(inWorktree, dir)
+				}
+			}
+			dirs = inWorktree
+		}
+	}
 
-	l := locationList{dirs}
+	w.wd, w.wsKind, w.wsRoot, w.dirs, w.hiddenPinned = wd, wsKind, wsRoot, dirs, hiddenPinned
+	w.todayVisits, w.old, w.lastVisits, w.suggested = nil, nil, nil, nil
+	if ns, ok := cfg.Store.(LocationNextLikelyStore); ok && cfg.SuggestNext && wd != "" {
+		w.suggested = suggestNext(ns, wd, dirs)
+	}
+	if ts, ok := cfg.Store.(LocationVisitTimesStore); ok && cfg.EmptyQueryOrder == LocationOrderByRecency {
+		w.lastVisits = map[string]time.Time{}
+		for _, dir := range dirs {
+			if _, last, err := ts.VisitTimes(dir.Path); err == nil {
+				w.lastVisits[dir.Path] = last
+			}
+		}
+	}
+	if rs, ok := cfg.Store.(LocationRecentVisitsStore); ok {
+		if cfg.ShowTodayBadge {
+			w.todayVisits = visitsSince(rs, dirs, startOfDay(time.Now()))
+		}
+		if cfg.DimOlderThan > 0 {
+			w.old = notVisitedSince(rs, dirs, time.Now().Add(-cfg.DimOlderThan))
+		}
+	}
+	if es, ok := cfg.Store.(LocationExpiryStore); ok && cfg.ShowTTL {
+		w.expiries = map[string]time.Time{}
+		for _, dir := range dirs {
+			if expiry, err := es.Expiry(dir.Path); err == nil && !expiry.IsZero() {
+				w.expiries[dir.Path] = expiry
+			}
+		}
+	}
+	w.projects = nil
+	if cfg.ProjectRoot != nil {
+		// ProjectRoot may walk the filesystem, so it is only called once for
+		// each directory rather than every time the filter changes or the list
+		// is redrawn.
+		w.projects = map[string]string{}
+		for _, dir := range dirs {
+			if name, ok := cfg.ProjectRoot(w.resolve(dir.Path)); ok {
+				w.projects[dir.Path] = name
+			}
+		}
+	}
+	if as, ok := cfg.Store.(LocationAliasStore); ok {
+		aliases := map[string]string{}
+		for _, dir := range dirs {
+			if alias, err := as.Alias(dir.Path); err == nil && alias != "" {
+				aliases[dir.Path] = alias
+			}
+		}
+		w.mutateState(func(s *locationState) { s.aliases = aliases })
+	}
+	if fs, ok := cfg.Store.(LocationFavoriteStore); ok {
+		favorites := map[string]bool{}
+		for _, dir := range dirs {
+			if fav, err := fs.IsFavorite(dir.Path); err == nil && fav {
+				favorites[dir.Path] = true
+			}
+		}
+		w.mutateState(func(s *locationState) { s.favorites = favorites })
+	}
+	w.groups = nil
+	if cfg.GroupByMount {
+		w.groups = make(map[string]string, len(dirs))
+		for _, dir := range dirs {
+			w.groups[dir.Path] = otherGroup
+			if mount, ok := w.mountPoint(w.resolve(dir.Path)); ok {
+				w.groups[dir.Path] = fsutil.TildeAbbr(mount)
+			}
+		}
+	} else if cfg.GroupByWorkspace && cfg.IterateWorkspaces != nil {
+		w.groups = make(map[string]string, len(dirs))
+		for _, dir := range dirs {
+			w.groups[dir.Path] = groupOf(dir.Path, wsKind, w.workspaces)
+		}
+	}
+	return nil
+}
 
-	w := tk.NewComboBox(tk.ComboBoxSpec{
-		CodeArea: tk.CodeAreaSpec{
-			Prompt:      modePrompt(" LOCATION ", true),
-			Highlighter: cfg.Filter.Highlighter,
-		},
-		ListBox: tk.ListBoxSpec{
-			Bindings: cfg.Bindings,
-			OnAccept: func(it tk.Items, i int) {
-				path := it.(locationList).dirs[i].Path
-				if strings.HasPrefix(path, wsKind) {
-					path = wsRoot + path[len(wsKind):]
+// Returns the working directory cleaned, and with symbolic links resolved if
+// LocationSpec.ResolveWdSymlinks is true and resolving succeeds.
+func (w *location) canonicalWd(wd string) string {
+	wd = filepath.Clean(wd)
+	if w.spec.ResolveWdSymlinks {
+		evalSymlinks := w.spec.EvalSymlinks
+		if evalSymlinks == nil {
+			evalSymlinks = filepath.EvalSymlinks
+		}
+		if resolved, err := evalSymlinks(wd); err == nil {
+			wd = resolved
+		}
+	}
+	return wd
+}
+
+// Closes the location mode after accepting, by calling LocationSpec.Close if
+// it is set and popping the addon otherwise.
+func (w *location) close() {
+	w.accepted = true
+	if w.spec.Close != nil {
+		w.spec.Close()
+	} else {
+		w.app.PopAddon()
+	}
+}
+
+// Notifies an error, unless there is no app, as in ExplainLocation.
+func (w *location) notifyError(err error) {
+	if w.app != nil {
+		w.app.Notify(ErrorText(err))
+	}
+}
+
+// Dismiss saves the filter if LocationSpec.QueryStore is set, and calls
+// LocationSpec.OnCancel and LocationSpec.OnClose. It is called when the addon
+// is closed; calls after the first one do nothing.
+func (w *location) Dismiss() {
+	if w.dismissed {
+		return
+	}
+	w.dismissed = true
+	w.endOpenAnimation()
+	w.stopWork()
+	if w.cancelPrefetch != nil {
+		w.cancelPrefetch()
+	}
+	if w.spec.QueryStore != nil {
+		w.spec.QueryStore.SaveQuery(w.CodeArea().CopyState().Buffer.Content)
+	}
+	onCancel, onClose, accepted := w.spec.OnCancel, w.spec.OnClose, w.accepted
+	if onCancel == nil && onClose == nil {
+		return
+	}
+	// Dismiss is called with the state of the app locked, for example by
+	// PopAddon, so calling back directly would deadlock callbacks that
+	// notify.
+	go func() {
+		if !accepted && onCancel != nil {
+			onCancel()
+		}
+		if onClose != nil {
+			onClose(accepted)
+		}
+	}()
+}
+
+// Handle handles the keys of LocationSpec.QuickFilters by replacing the filter
+// with their queries, and lets the combobox handle other events. Any event ends
+// the animation when opening.
+func (w *location) Handle(event term.Event) bool {
+	w.endOpenAnimation()
+	if k, ok := event.(term.KeyEvent); ok {
+		for _, qf := range w.spec.QuickFilters {
+			if ui.Key(k) == qf.Key {
+				w.CodeArea().MutateState(func(s *tk.CodeAreaState) {
+					s.Buffer = tk.CodeBuffer{Content: qf.Query, Dot: len(qf.Query)}
+				})
+				w.Refilter()
+				return true
+			}
+		}
+	}
+	return w.ComboBox.Handle(event)
+}
+
+// Render renders the combobox, and below it the footer and the preview if
+// there are any and the layout is not compact.
+func (w *location) Render(width, height int) *term.Buffer {
+	if w.compact {
+		return w.ComboBox.Render(width, height)
+	}
+	below := w.below()
+	belowHeight := below.MaxHeight(width, height/2)
+	if below.Content == nil || belowHeight == 0 {
+		return w.ComboBox.Render(width, height)
+	}
+	buf := w.ComboBox.Render(width, height-belowHeight)
+	buf.Extend(below.Render(width, belowHeight), false)
+	return buf
+}
+
+// MaxHeight returns the maximum height of the combobox, the footer and the
+// preview. It also determines whether the compact layout is used, since the
+// height passed to it is the height available to the location mode.
+func (w *location) MaxHeight(width, height int) int {
+	w.compact = height < w.spec.CompactBelowRows
+	if w.compact {
+		return w.openAnimationHeight(w.ComboBox.MaxHeight(width, height))
+	}
+	return w.openAnimationHeight(
+		w.ComboBox.MaxHeight(width, height) + w.below().MaxHeight(width, height/2))
+}
+
+// Returns the content shown below the combobox: footers if some directories
+// are omitted because of LocationSpec.Limit or LocationSpec.MaxPinned and the
+// match detail if LocationSpec.ShowMatchDetail is set, followed by the
+// preview. The footers are rendered here rather than as rows of the list
+// because tk.ListBox has no rows that can't be selected; as rows they would
+// also be scrolled out of view and accepted like directories.
+func (w *location) below() tk.Label {
+	var footers []ui.Text
+	if l, ok := w.ListBox().CopyState().Items.(locationList); ok && l.more > 0 {
+		footers = append(footers,
+			ui.T(fmt.Sprintf("+%d more (refine your query)", l.more), ui.Dim))
+	}
+	if w.hiddenPinned > 0 {
+		footers = append(footers,
+			ui.T(fmt.Sprintf("+%d more pinned", w.hiddenPinned), ui.Dim))
+	}
+	if w.spec.ShowMatchDetail {
+		if l, i, ok := w.selectedRow(); ok && !l.isHeader(i) {
+			if detail := w.matchDetail(l, l.entries[i]); detail != "" {
+				footers = append(footers, ui.T(detail, ui.Dim))
+			}
+		}
+	}
+	content := w.copyState().preview
+	for i := len(footers) - 1; i >= 0; i-- {
+		if content == nil {
+			content = footers[i]
+		} else {
+			content = ui.Concat(footers[i], ui.T("\n"), content)
+		}
+	}
+	return tk.Label{Content: content}
+}
+
+// Cancels background computations for the previous selection, and discards
+// their results.
+func (w *location) stopWork() {
+	w.workMutex.Lock()
+	defer w.workMutex.Unlock()
+	w.stopWorkLocked()
+}
+
+func (w *location) stopWorkLocked() {
+	if w.cancelWork != nil {
+		w.cancelWork()
+		w.cancelWork = nil
+	}
+	w.mutateState(func(s *locationState) { s.preview = nil })
+}
+
+// Cancels background computations for the previous selection, and starts
+// those for the newly selected path.
+func (w *location) startWork(path string) {
+	w.workMutex.Lock()
+	defer w.workMutex.Unlock()
+	w.stopWorkLocked()
+	_, counted := w.copyState().childCounts[path]
+	countChildren := w.spec.ShowChildCount && !counted
+	_, gitKnown := w.copyState().gitClean[path]
+	checkGit := w.spec.GitStatus != nil && !gitKnown
+	previewFn := w.previewFunc()
+	if previewFn == nil && !countChildren && !checkGit {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancelWork = cancel
+	dir := w.resolve(path)
+	if previewFn != nil {
+		w.beginBusy()
+		go func() {
+			defer w.endBusy()
+			preview := previewFn(ctx, dir)
+			w.finishWork(ctx, func(s *locationState) { s.preview = preview })
+		}()
+	}
+	if countChildren {
+		w.beginBusy()
+		go func() {
+			defer w.endBusy()
+			n, ok := w.countChildren(dir)
+			if !ok {
+				return
+			}
+			w.finishWork(ctx, func(s *locationState) {
+				childCounts := make(map[string]int, len(s.childCounts)+1)
+				for k, v := range s.childCounts {
+					childCounts[k] = v
 				}
-				err := cfg.Store.Chdir(path)
-				if err != nil {
-					app.Notify(ErrorText(err))
+				childCounts[path] = n
+				s.childCounts = childCounts
+			})
+		}()
+	}
+	if checkGit {
+		w.beginBusy()
+		go func() {
+			defer w.endBusy()
+			clean, ok := w.spec.GitStatus(dir)
+			if !ok {
+				return
+			}
+			w.finishWork(ctx, func(s *locationState) {
+				gitClean := make(map[string]bool, len(s.gitClean)+1)
+				for k, v := range s.gitClean {
+					gitClean[k] = v
 				}
-				app.PopAddon()
-			},
-		},
-		OnFilter: func(w tk.ComboBox, p string) {
-			w.ListBox().Reset(l.filter(cfg.Filter.makePredicate(p)), 0)
-		},
+				gitClean[path] = clean
+				s.gitClean = gitClean
+			})
+		}()
+	}
+}
+
+// Returns the function to compute the preview, which includes the recent
+// commands if LocationSpec.RecentCommands is positive and the store
+// implements LocationRecentCommandsStore. It returns nil if there is no
+// preview.
+func (w *location) previewFunc() func(context.Context, string) ui.Text {
+	cs, ok := w.spec.Store.(LocationRecentCommandsStore)
+	if !ok || w.spec.RecentCommands <= 0 {
+		return w.spec.Preview
+	}
+	return func(ctx context.Context, dir string) ui.Text {
+		var preview ui.Text
+		if w.spec.Preview != nil {
+			preview = w.spec.Preview(ctx, dir)
+		}
+		for _, cmd := range w.recentCommands(cs, dir) {
+			if preview != nil {
+				preview = ui.Concat(preview, ui.T("\n"))
+			}
+			preview = ui.Concat(preview, ui.T("$ ", ui.FgGreen), ui.T(cmd))
+		}
+		return preview
+	}
+}
+
+// Returns the cached recent commands run in dir, getting them from the store
+// if they are not cached. Errors are cached as no commands.
+func (w *location) recentCommands(cs LocationRecentCommandsStore, dir string) []string {
+	w.commandsMutex.Lock()
+	cmds, ok := w.commands[dir]
+	w.commandsMutex.Unlock()
+	if ok {
+		return cmds
+	}
+	cmds, err := cs.RecentCommands(dir, w.spec.RecentCommands)
+	if err != nil {
+		cmds = nil
+	}
+	w.commandsMutex.Lock()
+	defer w.commandsMutex.Unlock()
+	if w.commands == nil {
+		w.commands = map[string][]string{}
+	}
+	w.commands[dir] = cmds
+	return cmds
+}
+
+// Returns the number of immediate subdirectories of dir. The second return
+// value is false if dir can't be read or the MaxStats budget has been
+// exhausted.
+func (w *location) countChildren(dir string) (int, bool) {
+	r, ok := w.stats.ReadDir(dir)
+	if !ok || r.err != nil {
+		return 0, false
+	}
+	n := 0
+	for _, entry := range r.entries {
+		if entry.IsDir() {
+			n++
+		}
+	}
+	return n, true
+}
+
+// Starts calling Stat on the first n directories in a separate goroutine,
+// caching the results.
+func (w *location) prefetch(n int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancelPrefetch = cancel
+	dirs := w.dirs
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs {
+		paths[i] = w.resolve(dir.Path)
+	}
+	go func() {
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, ok := w.stats.Stat(path); !ok {
+				// Budget exhausted.
+				return
+			}
+		}
+	}()
+}
+
+// Stores the result of a background computation unless ctx has been canceled.
+func (w *location) finishWork(ctx context.Context, f func(*locationState)) {
+	w.workMutex.Lock()
+	defer w.workMutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	w.mutateState(f)
+	w.app.Redraw()
+}
+
+// The interval between frames of the spinner. It is a variable so that tests
+// can keep the spinner still.
+var spinnerInterval = 100 * time.Millisecond
+
+var spinnerFrames = []string{"|", "/", "-", `\`}
+
+// Marks the start of a background computation, starting to animate the
+// spinner if this is the only one in progress.
+func (w *location) beginBusy() {
+	w.busyMutex.Lock()
+	defer w.busyMutex.Unlock()
+	w.busy++
+	if w.busy == 1 && w.spec.ShowSpinner {
+		w.spinnerFrame = 0
+		w.stopSpinner = make(chan struct{})
+		go w.animateSpinner(spinnerInterval, w.stopSpinner)
+		w.app.Redraw()
+	}
+}
+
+// Marks the end of a background computation, stopping the spinner if there
+// are no more in progress.
+func (w *location) endBusy() {
+	w.busyMutex.Lock()
+	defer w.busyMutex.Unlock()
+	w.busy--
+	if w.busy == 0 && w.stopSpinner != nil {
+		close(w.stopSpinner)
+		w.stopSpinner = nil
+		w.app.Redraw()
+	}
+}
+
+func (w *location) animateSpinner(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.busyMutex.Lock()
+			w.spinnerFrame = (w.spinnerFrame + 1) % len(spinnerFrames)
+			w.busyMutex.Unlock()
+			w.app.Redraw()
+		}
+	}
+}
+
+// Returns the current frame of the spinner, or "" if there is no background
+// computation in progress.
+func (w *location) spinner() string {
+	w.busyMutex.Lock()
+	defer w.busyMutex.Unlock()
+	if w.busy == 0 {
+		return ""
+	}
+	return spinnerFrames[w.spinnerFrame]
+}
+
+func (w *location) rprompt() ui.Text {
+	var parts []string
+	if cycle := w.spec.MatcherCycle; len(cycle) > 0 {
+		parts = append(parts, "["+matcherName(cycle[w.copyState().matcher])+"]")
+	}
+	if w.spec.ShowSpinner {
+		if s := w.spinner(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if w.spec.ShowStatus && !w.compact {
+		if s := w.status(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return ui.T(strings.Join(parts, " "))
+}
+
+var locationOrderNames = []string{"score", "recency", "alpha"}
+
+// Returns the label of the prompt, with the flags described in
+// LocationSpec.RichPrompt if it is set.
+func (w *location) promptLabel() string {
+	if !w.spec.RichPrompt {
+		return " LOCATION "
+	}
+	var flags []string
+	if cycle := w.spec.MatcherCycle; len(cycle) > 0 {
+		flags = append(flags, matcherName(cycle[w.copyState().matcher]))
+	} else if w.spec.Matcher != nil {
+		flags = append(flags, matcherName(w.spec.Matcher))
+	}
+	if o := w.spec.EmptyQueryOrder; 0 <= o && int(o) < len(locationOrderNames) {
+		flags = append(flags, locationOrderNames[o])
+	}
+	if w.copyState().absolute {
+		flags = append(flags, "abs")
+	}
+	return " LOCATION [" + strings.Join(flags, "·") + "] "
+}
+
+// Returns the names of the active non-default options.
+func (w *location) activeOptions() []string {
+	var opts []string
+	if w.spec.Rank != nil {
+		opts = append(opts, "rank")
+	}
+	if w.spec.DebugScores {
+		opts = append(opts, "debug")
+	}
+	if _, ok := w.spec.Store.(LocationRecentVisitsStore); ok && w.spec.RecentWindow > 0 {
+		opts = append(opts, "recent")
+	}
+	if w.copyState().absolute {
+		opts = append(opts, "abs")
+	}
+	return opts
+}
+
+func (w *location) status() string {
+	var sb strings.Builder
+	for i, opt := range w.activeOptions() {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString("[" + opt + "]")
+	}
+	return sb.String()
+}
+
+// Calls RecordSelection if the store implements LocationSelectionStore.
+func (w *location) recordSelection(l locationList, i int) {
+	ss, ok := w.spec.Store.(LocationSelectionStore)
+	if !ok {
+		return
+	}
+	rank := 0
+	for j := 0; j < i; j++ {
+		if !l.isHeader(j) {
+			rank++
+		}
+	}
+	query := w.CodeArea().CopyState().Buffer.Content
+	if err := ss.RecordSelection(query, l.entries[i].Path, rank); err != nil {
+		w.app.Notify(ErrorText(err))
+	}
+}
+
+// Changes to or picks the given directory, which may be a workspace-relative
+// path, and closes the addon.
+func (w *location) accept(path string) {
+	if w.spec.Pick != nil {
+		w.spec.Pick(w.resolve(path))
+		w.close()
+		return
+	}
+	path = w.resolve(path)
+	if w.spec.Open != nil {
+		if info, err := w.stats.StatUnbudgeted(path); err == nil && !info.IsDir() {
+			if err := w.spec.Open(path, info); err != nil {
+				w.app.Notify(ErrorText(err))
+			}
+			w.close()
+			return
+		}
+	}
+	w.chdir(path)
+}
+
+// Resolves a possibly workspace-relative path to an absolute path.
+func (w *location) resolve(path string) string {
+	if strings.HasPrefix(path, w.wsKind) {
+		return w.wsRoot + path[len(w.wsKind):]
+	}
+	return path
+}
+
+// Returns the selected directory. The second return value is false if there is
+// no selection or a group header is selected.
+func (w *location) selected() (storedefs.Dir, bool) {
+	l, i, ok := w.selectedRow()
+	if !ok || l.isHeader(i) {
+		return storedefs.Dir{}, false
+	}
+	return l.entries[i].Dir, true
+}
+
+func (w *location) selectedRow() (locationList, int, bool) {
+	s := w.ListBox().CopyState()
+	l, ok := s.Items.(locationList)
+	if !ok || s.Selected < 0 || s.Selected >= l.Len() {
+		return locationList{}, 0, false
+	}
+	return l, s.Selected, true
+}
+
+// Reruns the filter and redraws, keeping the selection on the same row if it
+// is still present.
+func (w *location) refresh() {
+	selected := -1
+	old, i, ok := w.selectedRow()
+	l := w.filter(w.CodeArea().CopyState().Buffer.Content)
+	if ok {
+		selected = l.find(old.header(i), old.entries[i].Path)
+	}
+	if selected == -1 {
+		selected = 0
+	}
+	w.ListBox().Reset(l, selected)
+	w.app.Redraw()
+}
+
+// A row selected when the list was built with a filter.
+type locationSelection struct {
+	filter, header, path string
+}
+
+// Remembers the row selected in the list box for the last filter, if
+// LocationSpec.RememberSelections is positive.
+func (w *location) rememberSelection(lb tk.ListBox) {
+	max := w.spec.RememberSelections
+	if max <= 0 {
+		return
+	}
+	s := lb.CopyState()
+	l, ok := s.Items.(locationList)
+	if !ok || s.Selected < 0 || s.Selected >= l.Len() {
+		return
+	}
+	e := l.entries[s.Selected]
+	selections := make([]locationSelection, 0, len(w.selections)+1)
+	for _, sel := range w.selections {
+		if sel.filter != w.lastFilter {
+			selections = append(selections, sel)
+		}
+	}
+	selections = append(selections, locationSelection{w.lastFilter, e.header, e.Path})
+	if len(selections) > max {
+		selections = selections[len(selections)-max:]
+	}
+	w.selections = selections
+}
+
+// Returns the index of the row remembered for the filter if it is in the
+// list, or 0 otherwise.
+func (w *location) recallSelection(l locationList, filter string) int {
+	filter = normalizeQuery(filter)
+	for _, sel := range w.selections {
+		if sel.filter == filter {
+			if i := l.find(sel.header, sel.path); i != -1 {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+func (w *location) ToggleFavorite() {
+	fs, ok := w.spec.Store.(LocationFavoriteStore)
+	if !ok {
+		return
+	}
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	favorite := !w.copyState().favorites[dir.Path]
+	if err := fs.SetFavorite(dir.Path, favorite); err != nil {
+		w.app.Notify(ErrorText(err))
+		return
+	}
+	w.mutateState(func(s *locationState) {
+		favorites := make(map[string]bool, len(s.favorites)+1)
+		for path := range s.favorites {
+			favorites[path] = true
+		}
+		if favorite {
+			favorites[dir.Path] = true
+		} else {
+			delete(favorites, dir.Path)
+		}
+		s.favorites = favorites
 	})
-	return w, nil
+	w.refresh()
+}
+
+// The name of the group for directories outside any workspace.
+const otherGroup = "Other"
+
+func groupOf(path, wsKind string, workspaces []compiledWorkspace) string {
+	if !filepath.IsAbs(path) {
+		return wsKind
+	}
+	if kind, _ := matchWorkspace(workspaces, path); kind != "" {
+		return kind
+	}
+	return otherGroup
+}
+
+func (w *location) SetAlias(alias string) {
+	as, ok := w.spec.Store.(LocationAliasStore)
+	if !ok {
+		return
+	}
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	if err := as.SetAlias(dir.Path, alias); err != nil {
+		w.app.Notify(ErrorText(err))
+		return
+	}
+	w.mutateState(func(s *locationState) {
+		aliases := make(map[string]string, len(s.aliases)+1)
+		for path, alias := range s.aliases {
+			aliases[path] = alias
+		}
+		if alias == "" {
+			delete(aliases, dir.Path)
+		} else {
+			aliases[dir.Path] = alias
+		}
+		s.aliases = aliases
+	})
+	w.refresh()
+}
+
+func (w *location) ToggleGroup() {
+	if w.groups == nil {
+		return
+	}
+	l, i, ok := w.selectedRow()
+	if !ok {
+		return
+	}
+	group := l.header(i)
+	if group == "" {
+		group = w.groups[l.entries[i].Path]
+	}
+	w.mutateState(func(s *locationState) {
+		collapsed := make(map[string]bool, len(s.collapsed)+1)
+		for g := range s.collapsed {
+			collapsed[g] = true
+		}
+		if collapsed[group] {
+			delete(collapsed, group)
+		} else {
+			collapsed[group] = true
+		}
+		s.collapsed = collapsed
+	})
+	w.refresh()
+	// Keep the header of the toggled group selected.
+	if l, ok := w.ListBox().CopyState().Items.(locationList); ok {
+		if i := l.find(group, ""); i != -1 {
+			w.ListBox().Select(func(tk.ListBoxState) int { return i })
+		}
+	}
+}
+
+func (w *location) chdir(path string) {
+	w.changeDir(path)
+	w.close()
+}
+
+// Returns the root of the git worktree containing dir, or "" if dir is empty or
+// not in a git worktree, or if the MaxStats budget is exhausted before the root
+// is found.
+func (w *location) gitWorktreeRoot(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	for {
+		r, ok := w.stats.Stat(filepath.Join(dir, ".git"))
+		if !ok {
+			return ""
+		}
+		if r.err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Changes to the given absolute path, notifying the error if there is one.
+func (w *location) changeDir(path string) bool {
+	if info, err := w.stats.StatUnbudgeted(path); err == nil && !info.IsDir() {
+		if !w.spec.AcceptFileAsParent {
+			w.app.Notify(ErrorText(fmt.Errorf("not a directory: %s", path)))
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+	err := w.spec.Store.Chdir(path)
+	if err != nil {
+		w.app.Notify(ErrorText(err))
+		return false
+	}
+	if w.spec.Session != nil {
+		w.spec.Session.addAccepted(path)
+		w.spec.Session.Invalidate()
+	}
+	if rec, ok := w.spec.Store.(LocationDirRecorder); ok && w.spec.RecordAccepted && !w.spec.SuppressAcceptRecording {
+		if err := RecordChdir(rec, w.spec.IterateWorkspaces, path); err != nil {
+			w.app.Notify(ErrorText(err))
+		}
+	}
+	if w.spec.OnAcceptCommand != nil {
+		quoted := path
+		if w.spec.QuotePath != nil {
+			quoted = w.spec.QuotePath(path)
+		}
+		w.spec.OnAcceptCommand("cd " + quoted)
+	}
+	for _, f := range w.spec.PostAccept {
+		if err := f(path); err != nil {
+			w.app.Notify(ErrorText(err))
+			break
+		}
+	}
+	return true
+}
+
+func (w *location) AcceptInPlace() {
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	if !w.changeDir(w.resolve(dir.Path)) {
+		return
+	}
+	// Workspace-relative paths and what is hidden depend on the working
+	// directory, so reload everything.
+	w.stopWork()
+	if err := w.load(); err != nil {
+		w.app.Notify(ErrorText(err))
+	}
+	w.refresh()
+}
+
+func (w *location) JumpBack() {
+	if w.spec.Session == nil {
+		return
+	}
+	path := w.spec.Session.lastAccepted(w.wd)
+	if path == "" {
+		w.app.Notify(ErrorText(errNoLastAccepted))
+		return
+	}
+	if _, err := w.stats.StatUnbudgeted(path); err != nil {
+		w.app.Notify(ErrorText(err))
+		return
+	}
+	w.chdir(path)
+}
+
+func (w *location) ToggleMark() {
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	w.mutateState(func(s *locationState) {
+		for i, path := range s.marked {
+			if path == dir.Path {
+				s.marked = append(s.marked[:i:i], s.marked[i+1:]...)
+				return
+			}
+		}
+		s.marked = append(s.marked, dir.Path)
+	})
+}
+
+func (w *location) ToggleSticky() {
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	w.mutateState(func(s *locationState) {
+		sticky := make(map[string]bool, len(s.sticky)+1)
+		for path := range s.sticky {
+			sticky[path] = true
+		}
+		if sticky[dir.Path] {
+			delete(sticky, dir.Path)
+		} else {
+			sticky[dir.Path] = true
+		}
+		s.sticky = sticky
+	})
+	w.refresh()
+}
+
+func (w *location) isMarked(path string) bool {
+	for _, p := range w.copyState().marked {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *location) ToggleAbsolute() {
+	w.mutateState(func(s *locationState) { s.absolute = !s.absolute })
+	w.app.Redraw()
+}
+
+// Returns how path should be displayed.
+func (w *location) displayPath(path string) string {
+	if rel, ok := relativeTo(w.resolve(path), w.zoomRoot()); ok {
+		return rel
+	}
+	if w.copyState().absolute {
+		return path
+	}
+	return fsutil.TildeAbbr(path)
+}
+
+func (w *location) PushMarked() {
+	marked := w.copyState().marked
+	if len(marked) == 0 {
+		return
+	}
+	if w.spec.PushDirs != nil {
+		paths := make([]string, len(marked))
+		for i, path := range marked {
+			paths[i] = w.resolve(path)
+		}
+		w.spec.PushDirs(paths)
+	}
+	w.close()
+}
+
+// A cache of stat, directory reading and symlink reading results, which also
+// enforces a budget on the number of actual calls to the functions.
+type statCache struct {
+	mutex        sync.Mutex
+	statFunc     func(string) (os.FileInfo, error)
+	readDirFunc  func(string) ([]os.DirEntry, error)
+	readlinkFunc func(string) (string, error)
+	budget       int // negative means unlimited
+	results      map[string]statResult
+	dirResults   map[string]readDirResult
+	linkResults  map[string]readlinkResult
+}
+
+type statResult struct {
+	info os.FileInfo
+	err  error
+}
+
+type readDirResult struct {
+	entries []os.DirEntry
+	err     error
+}
+
+type readlinkResult struct {
+	target string
+	err    error
+}
+
+func newStatCache(stat func(string) (os.FileInfo, error), readDir func(string) ([]os.DirEntry, error), readlink func(string) (string, error), max int) *statCache {
+	if stat == nil {
+		stat = os.Stat
+	}
+	if readDir == nil {
+		readDir = os.ReadDir
+	}
+	if readlink == nil {
+		readlink = os.Readlink
+	}
+	if max <= 0 {
+		max = -1
+	}
+	return &statCache{statFunc: stat, readDirFunc: readDir, readlinkFunc: readlink, budget: max,
+		results: map[string]statResult{}, dirResults: map[string]readDirResult{},
+		linkResults: map[string]readlinkResult{}}
+}
+
+// Consumes one unit of the budget, returning false if it has been exhausted.
+// Must be called with the mutex held.
+func (c *statCache) take() bool {
+	if c.budget == 0 {
+		return false
+	}
+	if c.budget > 0 {
+		c.budget--
+	}
+	return true
+}
+
+// Stat returns the cached result of stat-ing path, calling the stat function
+// if there is no cached result. The second return value is false if there is
+// no cached result and the budget has been exhausted.
+func (c *statCache) Stat(path string) (statResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if r, ok := c.results[path]; ok {
+		return r, true
+	}
+	if !c.take() {
+		return statResult{}, false
+	}
+	info, err := c.statFunc(path)
+	r := statResult{info, err}
+	c.results[path] = r
+	return r, true
+}
+
+// StatUnbudgeted calls the stat function on path without consuming the budget
+// or using the cache. It is meant for one-off checks when a directory is
+// accepted, which should always see the current state of the filesystem;
+// features computed when the addon is open should use Stat instead.
+func (c *statCache) StatUnbudgeted(path string) (os.FileInfo, error) {
+	return c.statFunc(path)
+}
+
+// ReadDir is like Stat, but reads the directory at path instead.
+func (c *statCache) ReadDir(path string) (readDirResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if r, ok := c.dirResults[path]; ok {
+		return r, true
+	}
+	if !c.take() {
+		return readDirResult{}, false
+	}
+	entries, err := c.readDirFunc(path)
+	r := readDirResult{entries, err}
+	c.dirResults[path] = r
+	return r, true
+}
+
+// Readlink is like Stat, but reads the symbolic link at path instead.
+func (c *statCache) Readlink(path string) (readlinkResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if r, ok := c.linkResults[path]; ok {
+		return r, true
+	}
+	if !c.take() {
+		return readlinkResult{}, false
+	}
+	target, err := c.readlinkFunc(path)
+	r := readlinkResult{target, err}
+	c.linkResults[path] = r
+	return r, true
+}
+
+// Replaces the scores of dirs with the number of visits since the given time,
+// and sorts them by the new scores in descending order. Directories for which
+// the number of visits can't be determined keep their original scores.
+func scoreByRecentVisits(rs LocationRecentVisitsStore, dirs []storedefs.Dir, since time.Time) {
+	for i, dir := range dirs {
+		if n, err := rs.RecentVisits(dir.Path, since); err == nil {
+			dirs[i].Score = float64(n)
+		}
+	}
+	sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].Score > dirs[j].Score })
+}
+
+// Sorts the directories by their sort keys in descending order.
+func sortBySortKey(ss LocationSortKeyStore, dirs []storedefs.Dir) {
+	keys := make(map[string]float64, len(dirs))
+	for _, dir := range dirs {
+		keys[dir.Path] = ss.SortKey(dir)
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return keys[dirs[i].Path] > keys[dirs[j].Path]
+	})
+}
+
+// Removes directories with the same path as an earlier one, which gets the
+// highest score among them. The store should not return duplicate paths, but
+// this guards against buggy stores.
+func dedupDirs(dirs []storedefs.Dir) []storedefs.Dir {
+	index := make(map[string]int, len(dirs))
+	deduped := dirs[:0]
+	for _, dir := range dirs {
+		if i, ok := index[dir.Path]; ok {
+			deduped[i].Score = math.Max(deduped[i].Score, dir.Score)
+			continue
+		}
+		index[dir.Path] = len(deduped)
+		deduped = append(deduped, dir)
+	}
+	return deduped
+}
+
+// Merges directories whose paths are those of other directories followed by
+// one of the suffixes into the latter, keeping the higher score, and sorts the
+// result by score in descending order.
+func collapseSuffixes(dirs []storedefs.Dir, suffixes []string) []storedefs.Dir {
+	index := make(map[string]int, len(dirs))
+	for i, dir := range dirs {
+		index[dir.Path] = i
+	}
+	merged := make([]bool, len(dirs))
+	for i, dir := range dirs {
+		for _, suffix := range suffixes {
+			if suffix == "" || !strings.HasSuffix(dir.Path, suffix) {
+				continue
+			}
+			if j, ok := index[strings.TrimSuffix(dir.Path, suffix)]; ok {
+				dirs[j].Score = math.Max(dirs[j].Score, dir.Score)
+				merged[i] = true
+				break
+			}
+		}
+	}
+	collapsed := make([]storedefs.Dir, 0, len(dirs))
+	for i, dir := range dirs {
+		if !merged[i] {
+			collapsed = append(collapsed, dir)
+		}
+	}
+	sort.SliceStable(collapsed, func(i, j int) bool {
+		return collapsed[i].Score > collapsed[j].Score
+	})
+	return collapsed
+}
+
+// The number of directories suggested by LocationSpec.SuggestNext.
+const suggestNextCount = 3
+
+// Returns the ranks of the directories likely to be changed to next from wd,
+// ignoring those not in dirs, like hidden directories.
+func suggestNext(ns LocationNextLikelyStore, wd string, dirs []storedefs.Dir) map[string]int {
+	next, err := ns.NextLikely(wd, suggestNextCount)
+	if err != nil || len(next) == 0 {
+		return nil
+	}
+	shown := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		if dir.Score != pinnedScore {
+			shown[dir.Path] = true
+		}
+	}
+	suggested := map[string]int{}
+	for _, dir := range next {
+		if _, dup := suggested[dir.Path]; shown[dir.Path] && !dup {
+			suggested[dir.Path] = len(suggested)
+		}
+	}
+	return suggested
+}
+
+// Returns a map from paths to the number of visits since the given time,
+// omitting directories with no visits or for which the number can't be
+// determined.
+func visitsSince(rs LocationRecentVisitsStore, dirs []storedefs.Dir, since time.Time) map[string]int {
+	visits := map[string]int{}
+	for _, dir := range dirs {
+		if n, err := rs.RecentVisits(dir.Path, since); err == nil && n > 0 {
+			visits[dir.Path] = n
+		}
+	}
+	return visits
+}
+
+// Returns the set of non-pinned directories with no visits since the given
+// time, omitting those for which the number of visits can't be determined.
+func notVisitedSince(rs LocationRecentVisitsStore, dirs []storedefs.Dir, since time.Time) map[string]bool {
+	old := map[string]bool{}
+	for _, dir := range dirs {
+		if dir.Score == pinnedScore {
+			continue
+		}
+		if n, err := rs.RecentVisits(dir.Path, since); err == nil && n == 0 {
+			old[dir.Path] = true
+		}
+	}
+	return old
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
 }
 
 func hasPathPrefix(path, prefix string) bool {
@@ -129,16 +2277,24 @@ type LocationWSIterator func(func(kind, pattern string) bool)
 
 // Parse returns whether the path matches any kind of workspace. If there is
 // a match, it returns the kind of the workspace and the root. It there is no
-// match, it returns "", "".
+// match, it returns "", "". Invalid patterns and patterns that match the root
+// of the filesystem are ignored.
 func (ws LocationWSIterator) Parse(path string) (kind, root string) {
+	kind, root, _ = ws.ParseChecked(path)
+	return kind, root
+}
+
+// ParseChecked is like Parse, but also returns errors for invalid patterns and
+// patterns that match the root of the filesystem, which would otherwise be
+// silently ignored. A pattern that matches the root of the filesystem would
+// make every path part of a workspace.
+func (ws LocationWSIterator) ParseChecked(path string) (kind, root string, errs []error) {
 	var foundKind, foundRoot string
+	fsRoot := filepath.VolumeName(path) + string(filepath.Separator)
 	ws(func(kind, pattern string) bool {
-		if !strings.HasPrefix(pattern, "^") {
-			pattern = "^" + pattern
-		}
-		re, err := regexp.Compile(pattern)
+		re, err := compileWSPattern(kind, pattern, fsRoot)
 		if err != nil {
-			// TODO(xiaq): Surface the error.
+			errs = append(errs, err)
 			return true
 		}
 		if root := re.FindString(path); root != "" {
@@ -147,33 +2303,55 @@ func (ws LocationWSIterator) Parse(path string) (kind, root string) {
 		}
 		return true
 	})
-	return foundKind, foundRoot
+	return foundKind, foundRoot, errs
 }
 
-type locationList struct {
-	dirs []storedefs.Dir
+// A kind of workspace with its compiled pattern.
+type compiledWorkspace struct {
+	kind string
+	re   *regexp.Regexp
 }
 
-func (l locationList) filter(p func(string) bool) locationList {
-	var filteredDirs []storedefs.Dir
-	for _, dir := range l.dirs {
-		if p(fsutil.TildeAbbr(dir.Path)) {
-			filteredDirs = append(filteredDirs, dir)
+// Compiles the patterns of all the workspaces with compileWSPattern, returning
+// the valid ones in order and the errors for the others.
+func (ws LocationWSIterator) compile(fsRoot string) ([]compiledWorkspace, []error) {
+	var workspaces []compiledWorkspace
+	var errs []error
+	ws(func(kind, pattern string) bool {
+		re, err := compileWSPattern(kind, pattern, fsRoot)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			workspaces = append(workspaces, compiledWorkspace{kind, re})
 		}
-	}
-	return locationList{filteredDirs}
+		return true
+	})
+	return workspaces, errs
 }
 
-func (l locationList) Show(i int) ui.Text {
-	return ui.T(fmt.Sprintf("%s %s",
-		showScore(l.dirs[i].Score), fsutil.TildeAbbr(l.dirs[i].Path)))
+// Like LocationWSIterator.Parse, but with compiled workspaces.
+func matchWorkspace(workspaces []compiledWorkspace, path string) (kind, root string) {
+	for _, ws := range workspaces {
+		if root := ws.re.FindString(path); root != "" {
+			return ws.kind, root
+		}
+	}
+	return "", ""
 }
 
-func (l locationList) Len() int { return len(l.dirs) }
-
-func showScore(f float64) string {
-	if f == pinnedScore {
-		return "  *"
+// Compiles the pattern of a workspace of the given kind, which always matches
+// from the start of a path. It is an error if the pattern doesn't compile or
+// matches fsRoot, the root of the filesystem.
+func compileWSPattern(kind, pattern, fsRoot string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(pattern, "^") {
+		pattern = "^" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("workspace %s: %w", kind, err)
+	}
+	if re.MatchString(fsRoot) {
+		return nil, fmt.Errorf("workspace %s: %w", kind, errWSPatternTooBroad)
 	}
-	return fmt.Sprintf("%3.0f", f)
+	return re, nil
 }
@@ -0,0 +1,17 @@
+package modes
+
+import "os"
+
+// Returns whether the directory is likely not enterable by the current user.
+// This is best-effort: directories whose information is not available within
+// the MaxStats budget are assumed to be accessible.
+func (w *location) inaccessible(dir string) bool {
+	r, ok := w.stats.Stat(dir)
+	if !ok {
+		return false
+	}
+	if r.err != nil {
+		return os.IsPermission(r.err)
+	}
+	return !canEnter(r.info)
+}
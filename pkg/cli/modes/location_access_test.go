@@ -0,0 +1,39 @@
+package modes
+
+import (
+	"os"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+func TestLocation_MarkInaccessible(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/opt"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:            locationStore{storedDirs: dirs},
+		MarkInaccessible: true,
+		Stat: func(dir string) (os.FileInfo, error) {
+			switch dir {
+			case fixPath("/opt"):
+				return fileInfo{perm: 0o600}, nil
+			case fixPath("/tmp"):
+				return nil, os.ErrPermission
+			}
+			return fileInfo{perm: 0o755}, nil
+		},
+	})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr")),
+		ui.Concat(ui.T("100 "+fixPath("/opt"), ui.Dim), ui.T(" (no access)", ui.Dim, ui.FgRed)),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp"), ui.Dim), ui.T(" (no access)", ui.Dim, ui.FgRed))))
+}
@@ -0,0 +1,43 @@
+//go:build !windows && !plan9
+
+package modes
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns whether the current user can likely enter a directory with the
+// given information, judging from its permission bits. If the owner of the
+// directory can't be determined, it is enough for anyone to be able to enter
+// it.
+func canEnter(info os.FileInfo) bool {
+	perm := info.Mode().Perm()
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return perm&0o111 != 0
+	}
+	switch euid := os.Geteuid(); {
+	case euid == 0:
+		return true
+	case int(st.Uid) == euid:
+		return perm&0o100 != 0
+	case inGroup(int(st.Gid)):
+		return perm&0o010 != 0
+	default:
+		return perm&0o001 != 0
+	}
+}
+
+func inGroup(gid int) bool {
+	if gid == os.Getegid() {
+		return true
+	}
+	groups, _ := os.Getgroups()
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package modes
+
+import "os"
+
+func canEnter(info os.FileInfo) bool {
+	// Windows uses ACLs instead of permission bits, which are not exposed by
+	// os.FileInfo; only errors from stat are used to detect inaccessible
+	// directories.
+	return true
+}
@@ -0,0 +1,68 @@
+package modes
+
+import "time"
+
+// The interval between frames of the animation when opening. It is a variable
+// so that tests can control the animation.
+var openAnimationInterval = 30 * time.Millisecond
+
+// The number of frames of the animation when opening, including the last one
+// with the full height.
+const openAnimationFrames = 4
+
+// Starts the animation when opening, showing the first frame.
+func (w *location) startOpenAnimation() {
+	w.openMutex.Lock()
+	defer w.openMutex.Unlock()
+	w.openFrame = 1
+	w.stopOpenAnimation = make(chan struct{})
+	go w.animateOpen(openAnimationInterval, w.stopOpenAnimation)
+}
+
+func (w *location) animateOpen(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.openMutex.Lock()
+			w.openFrame++
+			done := w.openFrame >= openAnimationFrames
+			if done {
+				w.stopOpenAnimation = nil
+			}
+			w.openMutex.Unlock()
+			w.app.Redraw()
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// Ends the animation when opening if it is in progress, so that the full
+// height is used from the next rendering on.
+func (w *location) endOpenAnimation() {
+	w.openMutex.Lock()
+	defer w.openMutex.Unlock()
+	if w.stopOpenAnimation != nil {
+		close(w.stopOpenAnimation)
+		w.stopOpenAnimation = nil
+	}
+}
+
+// Returns the height to use in the current frame of the animation when opening,
+// given the full height. At least one row is always used.
+func (w *location) openAnimationHeight(full int) int {
+	w.openMutex.Lock()
+	defer w.openMutex.Unlock()
+	if w.stopOpenAnimation == nil {
+		return full
+	}
+	if h := full * w.openFrame / openAnimationFrames; h > 0 {
+		return h
+	}
+	return 1
+}
@@ -0,0 +1,60 @@
+package modes
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/testutil"
+	"src.elv.sh/pkg/ui"
+)
+
+var animationTestDirs = []storedefs.Dir{
+	{Path: fixPath("/usr/bin"), Score: 700},
+	{Path: fixPath("/usr"), Score: 600},
+	{Path: fixPath("/opt"), Score: 500},
+	{Path: fixPath("/tmp"), Score: 400},
+	{Path: fixPath("/home"), Score: 300},
+	{Path: fixPath("/etc"), Score: 200},
+	{Path: fixPath("/var"), Score: 100},
+}
+
+func TestLocation_OpenAnimation(t *testing.T) {
+	testutil.Set(t, &openAnimationInterval, time.Millisecond)
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: animationTestDirs},
+		OpenAnimation: true,
+	})
+	// The animation settles with the full height.
+	f.TTY.TestBuffer(t, locationBuf("",
+		"700 "+fixPath("/usr/bin"), "600 "+fixPath("/usr"), "500 "+fixPath("/opt"),
+		"400 "+fixPath("/tmp"), "300 "+fixPath("/home"), "200 "+fixPath("/etc"),
+		"100 "+fixPath("/var")))
+}
+
+func TestLocation_OpenAnimation_InterruptedByInput(t *testing.T) {
+	testutil.Set(t, &openAnimationInterval, time.Hour)
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: animationTestDirs},
+		OpenAnimation: true,
+	})
+	// The first frame has a quarter of the 8 rows, so the list has a scrollbar.
+	f.TTY.TestBuffer(t, term.NewBufferBuilder(50).
+		Newline(). // empty code area
+		WriteStyled(modeLine(" LOCATION ", true)).SetDotHere().
+		Newline().Write(fmt.Sprintf("%-49s", "700 "+fixPath("/usr/bin")), ui.Inverse).
+		Write(" ", ui.Inverse, ui.FgMagenta).Buffer())
+
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 0,
+		matchedRow("700 ", fixPath("/usr/bin"), "u"), matchedRow("600 ", fixPath("/usr"), "u")))
+}
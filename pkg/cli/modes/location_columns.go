@@ -0,0 +1,132 @@
+package modes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LocationColumn is an optional column of the location mode, shown between
+// the score and the path of each directory.
+type LocationColumn int
+
+// Possible values of LocationColumn.
+const (
+	// The modification time of the directory.
+	LocationModTimeColumn LocationColumn = iota
+	// The size of the directory entry itself, as reported by stat.
+	LocationSizeColumn
+	// The number of immediate subdirectories.
+	LocationChildCountColumn
+)
+
+var locationColumnNames = []string{"modtime", "size", "count"}
+
+func (c LocationColumn) String() string {
+	if 0 <= c && int(c) < len(locationColumnNames) {
+		return locationColumnNames[c]
+	}
+	return fmt.Sprintf("LocationColumn(%d)", int(c))
+}
+
+// ParseLocationColumn parses the name of a column, as returned by the String
+// method of LocationColumn.
+func ParseLocationColumn(name string) (LocationColumn, error) {
+	for i, s := range locationColumnNames {
+		if s == name {
+			return LocationColumn(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown column %q, must be one of %s",
+		name, strings.Join(locationColumnNames, ", "))
+}
+
+// Widths of the columns; cells with no information are blank.
+var locationColumnWidths = []int{len("2006-01-02"), 5, 3}
+
+// Returns the content of a column for the given absolute path, padded to the
+// width of the column. Information from the filesystem is only available
+// while the MaxStats budget lasts.
+func (w *location) showColumn(c LocationColumn, dir string) string {
+	var s string
+	switch c {
+	case LocationModTimeColumn:
+		if r, ok := w.stats.Stat(dir); ok && r.err == nil {
+			s = r.info.ModTime().Format("2006-01-02")
+		}
+	case LocationSizeColumn:
+		if r, ok := w.stats.Stat(dir); ok && r.err == nil {
+			s = humanSize(r.info.Size())
+		}
+	case LocationChildCountColumn:
+		if n, ok := w.countChildren(dir); ok {
+			s = fmt.Sprint(n)
+		}
+	}
+	return fmt.Sprintf("%*s", locationColumnWidths[c], s)
+}
+
+// Formats a size in bytes in at most 5 characters, like "512", "4.0K" or
+// "12M".
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprint(n)
+	}
+	f := float64(n)
+	for _, unit := range "KMGTP" {
+		f /= 1024
+		if f < 10 {
+			return fmt.Sprintf("%.1f%c", f, unit)
+		} else if f < 1024 || unit == 'P' {
+			return fmt.Sprintf("%.0f%c", f, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// HumanDuration formats a duration in its largest whole unit, like "45s",
+// "12m", "3h" or "2d".
+func HumanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+}
+
+// ToggleColumn shows the column if it is hidden, as the last column, and hides
+// it otherwise.
+func (w *location) ToggleColumn(c LocationColumn) {
+	w.mutateState(func(s *locationState) {
+		columns := make([]LocationColumn, 0, len(s.columns)+1)
+		for _, col := range s.columns {
+			if col != c {
+				columns = append(columns, col)
+			}
+		}
+		if len(columns) == len(s.columns) {
+			columns = append(columns, c)
+		}
+		s.columns = columns
+	})
+	w.app.Redraw()
+}
+
+// CycleColumns makes the second shown column the first one, moving the
+// first one to the end.
+func (w *location) CycleColumns() {
+	w.mutateState(func(s *locationState) {
+		if len(s.columns) < 2 {
+			return
+		}
+		columns := make([]LocationColumn, 0, len(s.columns))
+		columns = append(columns, s.columns[1:]...)
+		s.columns = append(columns, s.columns[0])
+	})
+	w.app.Redraw()
+}
@@ -0,0 +1,116 @@
+package modes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/tt"
+	"src.elv.sh/pkg/ui"
+)
+
+func TestHumanSize(t *testing.T) {
+	tt.Test(t, tt.Fn("humanSize", humanSize), tt.Table{
+		Args(int64(0)).Rets("0"),
+		Args(int64(512)).Rets("512"),
+		Args(int64(4096)).Rets("4.0K"),
+		Args(int64(12 << 20)).Rets("12M"),
+		Args(int64(3 << 30)).Rets("3.0G"),
+	})
+}
+
+func TestHumanDuration(t *testing.T) {
+	tt.Test(t, tt.Fn("HumanDuration", HumanDuration), tt.Table{
+		Args(time.Duration(0)).Rets("0s"),
+		Args(45 * time.Second).Rets("45s"),
+		Args(12*time.Minute + 30*time.Second).Rets("12m"),
+		Args(3*time.Hour + 59*time.Minute).Rets("3h"),
+		Args(50 * time.Hour).Rets("2d"),
+	})
+}
+
+func TestParseLocationColumn(t *testing.T) {
+	for _, c := range []LocationColumn{
+		LocationModTimeColumn, LocationSizeColumn, LocationChildCountColumn} {
+		got, err := ParseLocationColumn(c.String())
+		if got != c || err != nil {
+			t.Errorf("ParseLocationColumn(%q) -> %v, %v, want %v, nil", c.String(), got, err, c)
+		}
+	}
+	if _, err := ParseLocationColumn("bad"); err == nil {
+		t.Errorf("ParseLocationColumn(%q) -> no error", "bad")
+	}
+}
+
+func TestLocation_Columns(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	mtime := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:   locationStore{storedDirs: dirs},
+		Columns: []LocationColumn{LocationSizeColumn},
+		Stat: func(dir string) (os.FileInfo, error) {
+			if dir == fixPath("/tmp") {
+				return nil, errMock
+			}
+			return fileInfo{size: 4096, mtime: mtime}, nil
+		},
+		ReadDir: func(string) ([]os.DirEntry, error) {
+			return []os.DirEntry{dirEntry{"a", true}, dirEntry{"b", true}}, nil
+		},
+	})
+	startMode(f.App, w, err)
+	// Directories that can't be stat-ed have blank cells.
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200  4.0K "+fixPath("/usr")),
+		ui.T(" 50       "+fixPath("/tmp"))))
+
+	w.ToggleColumn(LocationModTimeColumn)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200  4.0K 2020-01-02 "+fixPath("/usr")),
+		ui.T(" 50                  "+fixPath("/tmp"))))
+
+	w.CycleColumns()
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 2020-01-02  4.0K "+fixPath("/usr")),
+		ui.T(" 50                  "+fixPath("/tmp"))))
+
+	w.ToggleColumn(LocationSizeColumn)
+	w.ToggleColumn(LocationChildCountColumn)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 2020-01-02   2 "+fixPath("/usr")),
+		ui.T(" 50              2 "+fixPath("/tmp"))))
+
+	w.ToggleColumn(LocationModTimeColumn)
+	w.ToggleColumn(LocationChildCountColumn)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+}
+
+// A fake os.FileInfo.
+type fileInfo struct {
+	size    int64
+	mtime   time.Time
+	perm    os.FileMode
+	regular bool
+}
+
+func (fi fileInfo) Name() string { return "" }
+func (fi fileInfo) Size() int64  { return fi.size }
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.regular {
+		return fi.perm
+	}
+	return os.ModeDir | fi.perm
+}
+func (fi fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi fileInfo) IsDir() bool        { return !fi.regular }
+func (fi fileInfo) Sys() any           { return nil }
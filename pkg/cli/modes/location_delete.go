@@ -0,0 +1,144 @@
+package modes
+
+import (
+	"fmt"
+
+	"src.elv.sh/pkg/cli"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/fsutil"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+// LocationDeleteStore is an optional interface a LocationStore can implement
+// to support deleting directories from the history.
+type LocationDeleteStore interface {
+	DelDir(dir string) error
+}
+
+// The default value of LocationSpec.BulkDeleteConfirmThreshold.
+const defaultBulkDeleteConfirmThreshold = 1
+
+func (w *location) Delete() {
+	ds, ok := w.spec.Store.(LocationDeleteStore)
+	if !ok {
+		return
+	}
+	paths := w.copyState().marked
+	if len(paths) == 0 {
+		dir, ok := w.selected()
+		if !ok {
+			return
+		}
+		paths = []string{dir.Path}
+	}
+	threshold := w.spec.BulkDeleteConfirmThreshold
+	if threshold == 0 {
+		threshold = defaultBulkDeleteConfirmThreshold
+	}
+	top, score, ok := w.topScored(paths)
+	highScore := ok && w.spec.DeleteConfirmScore > 0 && score > w.spec.DeleteConfirmScore
+	var message string
+	switch {
+	case highScore && len(paths) == 1:
+		message = fmt.Sprintf("Delete %s with score %s from history? (y/n)",
+			fsutil.TildeAbbr(top), w.formatScore(score))
+	case highScore:
+		message = fmt.Sprintf("Delete %d directories, including %s with score %s, from history? (y/n)",
+			len(paths), fsutil.TildeAbbr(top), w.formatScore(score))
+	case threshold >= 0 && len(paths) > threshold:
+		message = fmt.Sprintf("Delete %d directories from history? (y/n)", len(paths))
+	default:
+		w.deleteDirs(ds, paths)
+		return
+	}
+	w.app.PushAddon(locationConfirm{w.app, message,
+		func() { w.deleteDirs(ds, paths) }})
+	w.app.Redraw()
+}
+
+// Returns the path with the highest score among the given paths in the
+// directory history, along with the score. Pinned directories are ignored.
+func (w *location) topScored(paths []string) (string, float64, bool) {
+	want := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		want[path] = true
+	}
+	var top storedefs.Dir
+	found := false
+	for _, dir := range w.dirs {
+		if want[dir.Path] && dir.Score != pinnedScore && (!found || dir.Score > top.Score) {
+			top, found = dir, true
+		}
+	}
+	return top.Path, top.Score, found
+}
+
+// Deletes the directories from the store and the list. Directories that can't
+// be deleted from the store are kept, and the errors are notified.
+func (w *location) deleteDirs(ds LocationDeleteStore, paths []string) {
+	deleted := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if err := ds.DelDir(path); err != nil {
+			w.app.Notify(ErrorText(err))
+			continue
+		}
+		deleted[path] = true
+	}
+	if len(deleted) > 0 && w.spec.Session != nil {
+		w.spec.Session.Invalidate()
+	}
+	var dirs []storedefs.Dir
+	for _, dir := range w.dirs {
+		if !deleted[dir.Path] {
+			dirs = append(dirs, dir)
+		}
+	}
+	w.dirs = dirs
+	w.mutateState(func(s *locationState) {
+		var marked []string
+		for _, path := range s.marked {
+			if !deleted[path] {
+				marked = append(marked, path)
+			}
+		}
+		s.marked = marked
+	})
+	w.refresh()
+}
+
+// A widget asking for a confirmation. Pressing y calls the action; pressing any
+// other key cancels. The widget is closed in either case.
+type locationConfirm struct {
+	app     cli.App
+	message string
+	action  func()
+}
+
+func (w locationConfirm) Render(width, height int) *term.Buffer {
+	buf := w.render(width)
+	buf.TrimToLines(0, height)
+	return buf
+}
+
+func (w locationConfirm) MaxHeight(width, height int) int {
+	return len(w.render(width).Lines)
+}
+
+func (w locationConfirm) render(width int) *term.Buffer {
+	return term.NewBufferBuilder(width).
+		WriteStyled(modeLine(" CONFIRM ", true)).
+		WriteStyled(ui.T(w.message)).SetDotHere().Buffer()
+}
+
+func (w locationConfirm) Handle(event term.Event) bool {
+	if _, ok := event.(term.KeyEvent); !ok {
+		return false
+	}
+	w.app.PopAddon()
+	if event == term.K('y') {
+		w.action()
+	}
+	w.app.Redraw()
+	return true
+}
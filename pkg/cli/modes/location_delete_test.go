@@ -0,0 +1,164 @@
+package modes
+
+import (
+	"reflect"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+// A LocationStore that also implements LocationDeleteStore, recording the
+// deleted directories.
+type deleteStore struct {
+	locationStore
+	deleted *[]string
+	failing map[string]bool
+}
+
+func (s deleteStore) DelDir(dir string) error {
+	if s.failing[dir] {
+		return errMock
+	}
+	*s.deleted = append(*s.deleted, dir)
+	return nil
+}
+
+var deleteTestDirs = []storedefs.Dir{
+	{Path: fixPath("/usr"), Score: 200},
+	{Path: fixPath("/tmp"), Score: 100},
+	{Path: fixPath("/opt"), Score: 50},
+}
+
+func TestLocation_Delete_Selected(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var deleted []string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: deleteStore{locationStore{storedDirs: deleteTestDirs}, &deleted, nil}})
+	startMode(f.App, w, err)
+
+	// A single directory is deleted without confirmation.
+	w.Delete()
+	f.TTY.TestBuffer(t, locationBuf("", "100 "+fixPath("/tmp"), " 50 "+fixPath("/opt")))
+	if want := []string{fixPath("/usr")}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted %v, want %v", deleted, want)
+	}
+}
+
+func TestLocation_Delete_MarkedWithConfirmation(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var deleted []string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: deleteStore{locationStore{storedDirs: deleteTestDirs}, &deleted, nil}})
+	startMode(f.App, w, err)
+	w.ToggleMark()
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr"), ui.Bold),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"))))
+	w.ToggleMark()
+
+	confirmBuf := locationRowsBuilder("", 1,
+		ui.T("200 "+fixPath("/usr"), ui.Bold),
+		ui.T("100 "+fixPath("/tmp"), ui.Bold),
+		ui.T(" 50 "+fixPath("/opt"))).
+		Newline().WriteStyled(modeLine(" CONFIRM ", true)).
+		Write("Delete 2 directories from history? (y/n)").SetDotHere().Buffer()
+
+	// Canceled.
+	w.Delete()
+	f.TTY.TestBuffer(t, confirmBuf)
+	f.TTY.Inject(term.K('n'))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr"), ui.Bold),
+		ui.T("100 "+fixPath("/tmp"), ui.Bold),
+		ui.T(" 50 "+fixPath("/opt"))))
+	if len(deleted) != 0 {
+		t.Errorf("got deleted %v after canceling, want none", deleted)
+	}
+
+	// Confirmed.
+	w.Delete()
+	f.TTY.TestBuffer(t, confirmBuf)
+	f.TTY.Inject(term.K('y'))
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/opt")))
+	if want := []string{fixPath("/usr"), fixPath("/tmp")}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted %v, want %v", deleted, want)
+	}
+}
+
+func TestLocation_Delete_BelowThreshold(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var deleted []string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:                      deleteStore{locationStore{storedDirs: deleteTestDirs}, &deleted, nil},
+		BulkDeleteConfirmThreshold: 2,
+	})
+	startMode(f.App, w, err)
+	w.ToggleMark()
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr"), ui.Bold),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"))))
+	w.ToggleMark()
+
+	w.Delete()
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/opt")))
+	if len(f.App.CopyState().Addons) != 1 {
+		t.Errorf("confirmation asked when deleting below threshold")
+	}
+}
+
+func TestLocation_Delete_HighScore(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var deleted []string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:              deleteStore{locationStore{storedDirs: deleteTestDirs}, &deleted, nil},
+		DeleteConfirmScore: 150,
+	})
+	startMode(f.App, w, err)
+
+	// A high-score directory is deleted with confirmation.
+	w.Delete()
+	f.TTY.TestBuffer(t, locationRowsBuilder("", 0,
+		ui.T("200 "+fixPath("/usr")), ui.T("100 "+fixPath("/tmp")), ui.T(" 50 "+fixPath("/opt"))).
+		Newline().WriteStyled(modeLine(" CONFIRM ", true)).
+		Write("Delete "+fixPath("/usr")+" with score 200 from history? (y/n)").
+		SetDotHere().Buffer())
+	f.TTY.Inject(term.K('y'))
+	f.TTY.TestBuffer(t, locationBuf("", "100 "+fixPath("/tmp"), " 50 "+fixPath("/opt")))
+
+	// A low-score one is deleted without.
+	w.Delete()
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/opt")))
+	if want := []string{fixPath("/usr"), fixPath("/tmp")}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted %v, want %v", deleted, want)
+	}
+}
+
+func TestLocation_Delete_Error(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var deleted []string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: deleteStore{locationStore{storedDirs: deleteTestDirs}, &deleted,
+			map[string]bool{fixPath("/usr"): true}}})
+	startMode(f.App, w, err)
+	w.Delete()
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+}
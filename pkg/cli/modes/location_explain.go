@@ -0,0 +1,40 @@
+package modes
+
+// LocationMatchExplanation explains whether a directory matches a query of the
+// location mode.
+type LocationMatchExplanation struct {
+	// The path of the directory, as stored.
+	Path string
+	// Whether the directory matches the query.
+	Matched bool
+	// The byte ranges of the abbreviated path that matched, as returned by
+	// the matcher.
+	Highlights [][2]int
+	// A short description of why the directory matched or not, like "path
+	// matched" or "not a favorite".
+	Reason string
+}
+
+// ExplainLocation resolves the directories the same way as NewLocation, and
+// explains for each of them whether it matches the query. It doesn't need an
+// app, and errors that would be notified are ignored.
+//
+// This is useful for testing configurations and matchers, and for debugging
+// queries that don't match as expected.
+func ExplainLocation(cfg LocationSpec, query string) ([]LocationMatchExplanation, error) {
+	if cfg.Store == nil {
+		return nil, errNoDirectoryHistoryStore
+	}
+	w := &location{spec: cfg,
+		stats: newStatCache(cfg.Stat, cfg.ReadDir, cfg.Readlink, cfg.MaxStats)}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	_, q := w.parseQuery(query)
+	explanations := make([]LocationMatchExplanation, len(w.dirs))
+	for i, dir := range w.dirs {
+		matched, highlights, reason := w.matchDir(q, dir)
+		explanations[i] = LocationMatchExplanation{dir.Path, matched, highlights, reason}
+	}
+	return explanations, nil
+}
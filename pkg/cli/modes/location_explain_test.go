@@ -0,0 +1,75 @@
+package modes
+
+import (
+	"reflect"
+	"testing"
+
+	"src.elv.sh/pkg/store/storedefs"
+)
+
+var explainTestDirs = []storedefs.Dir{
+	{Path: fixPath("/usr/bin"), Score: 200},
+	{Path: fixPath("/tmp"), Score: 100},
+	{Path: fixPath("/opt/bar"), Score: 50},
+}
+
+func TestExplainLocation(t *testing.T) {
+	store := aliasStore{locationStore{storedDirs: explainTestDirs},
+		map[string]string{fixPath("/tmp"): "bin"}, nil}
+	tests := []struct {
+		name    string
+		matcher LocationMatcher
+		query   string
+		want    []LocationMatchExplanation
+	}{
+		{
+			name:    "substring matcher",
+			matcher: SubstringMatcher{},
+			query:   "bin",
+			want: []LocationMatchExplanation{
+				{fixPath("/usr/bin"), true, [][2]int{{5, 8}}, "path matched"},
+				{fixPath("/tmp"), true, nil, "alias matched"},
+				{fixPath("/opt/bar"), false, nil, "path not matched"},
+			},
+		},
+		{
+			name:    "subsequence matcher",
+			matcher: SubsequenceMatcher{},
+			query:   "br",
+			want: []LocationMatchExplanation{
+				{fixPath("/usr/bin"), false, nil, "path not matched"},
+				{fixPath("/tmp"), false, nil, "path not matched"},
+				{fixPath("/opt/bar"), true, [][2]int{{5, 6}, {7, 8}}, "path matched"},
+			},
+		},
+		{
+			name:    "depth token",
+			matcher: SubstringMatcher{},
+			query:   "depth=1",
+			want: []LocationMatchExplanation{
+				{fixPath("/usr/bin"), false, nil, "depth 2 does not satisfy depth=1"},
+				{fixPath("/tmp"), true, nil, "path matched"},
+				{fixPath("/opt/bar"), false, nil, "depth 2 does not satisfy depth=1"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ExplainLocation(
+				LocationSpec{Store: store, Matcher: test.matcher}, test.query)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExplainLocation_NoStore(t *testing.T) {
+	_, err := ExplainLocation(LocationSpec{}, "")
+	if err != errNoDirectoryHistoryStore {
+		t.Errorf("got error %v, want %v", err, errNoDirectoryHistoryStore)
+	}
+}
@@ -0,0 +1,118 @@
+package modes
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"src.elv.sh/pkg/fsutil"
+)
+
+// A pattern in an ignore file.
+type ignorePattern struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// Parses ignore patterns, one per line, with a syntax similar to gitignore:
+//
+//   - Empty lines and lines starting with # are ignored.
+//   - A leading ! negates the pattern, including directories excluded by
+//     previous patterns.
+//   - A pattern containing a slash, other than a trailing one, is matched
+//     against the whole path; a leading ~/ stands for the home directory.
+//     Other patterns are matched against each component of the path.
+//   - * matches anything but a slash, ? matches any character but a slash,
+//     and ** matches anything, including slashes. Character classes like
+//     [a-z] are also supported.
+//
+// A pattern that matches a directory also matches all the directories under
+// it. Patterns that can't be parsed are returned as errors.
+func parseIgnorePatterns(content string) ([]ignorePattern, []error) {
+	var patterns []ignorePattern
+	var errs []error
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		pattern := strings.TrimSuffix(strings.TrimPrefix(line, "!"), "/")
+		if strings.HasPrefix(pattern, "~/") {
+			if home, err := fsutil.GetHome(""); err == nil {
+				pattern = filepath.ToSlash(home) + pattern[1:]
+			}
+		}
+		var prefix string
+		if strings.Contains(pattern, "/") {
+			prefix = "^/"
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else {
+			prefix = "(^|/)"
+		}
+		re, err := regexp.Compile(prefix + globToRegexp(pattern) + "(/|$)")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		patterns = append(patterns, ignorePattern{re, negate})
+	}
+	return patterns, errs
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				sb.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 0 {
+				sb.WriteString(glob[i : i+j+1])
+				i += j
+			} else {
+				sb.WriteString(`\[`)
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// Returns whether the absolute path is ignored by the patterns. The last
+// pattern that matches decides.
+func ignored(patterns []ignorePattern, path string) bool {
+	path = filepath.ToSlash(path[len(filepath.VolumeName(path)):])
+	ignore := false
+	for _, p := range patterns {
+		if p.re.MatchString(path) {
+			ignore = !p.negate
+		}
+	}
+	return ignore
+}
+
+// Reads the ignore patterns from a file. A file that doesn't exist has no
+// patterns.
+func readIgnoreFile(name string) ([]ignorePattern, []error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, []error{err}
+	}
+	return parseIgnorePatterns(string(content))
+}
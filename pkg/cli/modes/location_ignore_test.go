@@ -0,0 +1,85 @@
+package modes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/testutil"
+	"src.elv.sh/pkg/tt"
+)
+
+const testIgnoreFile = `
+# Comments and empty lines are ignored.
+
+*.cache
+/opt/build*
+!/opt/build-keep
+node_modules/
+**/tmp/**
+`
+
+func TestIgnored(t *testing.T) {
+	patterns, errs := parseIgnorePatterns(testIgnoreFile)
+	if len(errs) > 0 {
+		t.Fatalf("got errors %v", errs)
+	}
+	ignoredPath := func(path string) bool { return ignored(patterns, path) }
+	tt.Test(t, tt.Fn("ignored", ignoredPath), tt.Table{
+		Args(fixPath("/usr")).Rets(false),
+		Args(fixPath("/opt/a.cache")).Rets(true),
+		Args(fixPath("/opt/a.cache/sub")).Rets(true),
+		Args(fixPath("/opt/build1")).Rets(true),
+		Args(fixPath("/opt/build-keep")).Rets(false),
+		Args(fixPath("/src/opt/build1")).Rets(false),
+		Args(fixPath("/src/node_modules")).Rets(true),
+		Args(fixPath("/src/node_modules/x")).Rets(true),
+		Args(fixPath("/src/node_modules_x")).Rets(false),
+		Args(fixPath("/var/tmp")).Rets(false),
+		Args(fixPath("/var/tmp/x")).Rets(true),
+	})
+}
+
+func TestParseIgnorePatterns_Error(t *testing.T) {
+	_, errs := parseIgnorePatterns("[z-a]\nok")
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want 1 error", errs)
+	}
+}
+
+func TestLocation_IgnoreFile(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	ignoreFile := filepath.Join(testutil.TempDir(t), "location-ignore")
+	os.WriteFile(ignoreFile, []byte(testIgnoreFile), 0o600)
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/opt/build1"), Score: 300},
+		{Path: fixPath("/opt/build-keep"), Score: 200},
+		{Path: fixPath("/src/node_modules/x"), Score: 100},
+		{Path: fixPath("/usr"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: dirs},
+		IteratePinned: func(f func(string)) { f(fixPath("/opt/build2")) },
+		IgnoreFile:    ignoreFile,
+	})
+	// Pinned directories are not ignored.
+	f.TTY.TestBuffer(t, locationBuf("",
+		"  * "+fixPath("/opt/build2"),
+		"200 "+fixPath("/opt/build-keep"),
+		" 50 "+fixPath("/usr")))
+}
+
+func TestLocation_IgnoreFile_NotExist(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:      locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/usr"), Score: 50}}},
+		IgnoreFile: filepath.Join(testutil.TempDir(t), "nonexistent"),
+	})
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/usr")))
+}
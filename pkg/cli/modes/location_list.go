@@ -0,0 +1,602 @@
+package modes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"src.elv.sh/pkg/fsutil"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+	"src.elv.sh/pkg/wcwidth"
+)
+
+func (w *location) filter(p string) locationList {
+	p, q := w.parseQuery(p)
+	aliases := q.aliases
+	var entries []locationEntry
+	for _, dir := range w.dirs {
+		if ok, highlights, _ := w.matchDir(q, dir); ok {
+			entries = append(entries, locationEntry{Dir: dir, highlights: highlights})
+		}
+	}
+	if p == "" {
+		w.orderEmptyQuery(entries)
+		if len(w.suggested) > 0 {
+			w.moveSuggested(entries)
+		}
+	}
+	l := locationList{loc: w, entries: entries, count: len(entries),
+		generation: atomic.AddInt64(&w.generation, 1)}
+	if w.spec.ShowPercentile {
+		computePercentiles(entries)
+	}
+	if w.spec.Rank != nil && p != "" {
+		for i := range entries {
+			entries[i].rank = w.spec.Rank(p, fsutil.TildeAbbr(entries[i].Path))
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].rank > entries[j].rank
+		})
+		l.showRanks = w.spec.DebugScores
+	}
+	if sticky := w.copyState().sticky; len(sticky) > 0 {
+		// Move sticky directories to just below pinned directories.
+		rank := func(e locationEntry) int {
+			switch {
+			case e.Score == pinnedScore:
+				return 0
+			case sticky[e.Path]:
+				return 1
+			default:
+				return 2
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return rank(entries[i]) < rank(entries[j])
+		})
+	}
+	if p != "" && len(aliases) > 0 {
+		// Move directories whose alias is exactly the filter to the top.
+		sort.SliceStable(entries, func(i, j int) bool {
+			return aliases[entries[i].Path] == p && aliases[entries[j].Path] != p
+		})
+	}
+	if w.spec.Limit > 0 && len(entries) > w.spec.Limit {
+		l.entries, l.more = entries[:w.spec.Limit], len(entries)-w.spec.Limit
+	}
+	l.scoreWidth = w.scoreColumnWidth(l.entries)
+	if w.spec.HeatmapColoring {
+		for _, e := range entries {
+			if e.Score != pinnedScore && e.Score > l.maxScore {
+				l.maxScore = e.Score
+			}
+		}
+	}
+	return w.group(l)
+}
+
+// The parsed filter of the location mode.
+type locationQuery struct {
+	match      func(string) (bool, [][2]int)
+	depthPreds []depthPredicate
+	favOnly    bool
+	zoomRoot   string
+	aliases    map[string]string
+	favorites  map[string]bool
+}
+
+// Parses the filter, returning the part of it to match paths against and the
+// parsed query. The filter is normalized first with normalizeQuery, and
+// filters shorter than LocationSpec.MinQueryLen are then treated as empty.
+func (w *location) parseQuery(p string) (string, locationQuery) {
+	p = normalizeQuery(p)
+	if utf8.RuneCountInString(p) < w.spec.MinQueryLen {
+		p = ""
+	}
+	p, depthPreds := parseDepthTokens(p)
+	p, favOnly := parseFavToken(p)
+	state := w.copyState()
+	return p, locationQuery{w.matcher(p), depthPreds, favOnly, w.zoomRoot(),
+		state.aliases, state.favorites}
+}
+
+// Matches a directory against the query, returning whether it matched, the
+// highlights within its abbreviated path and the reason for the decision.
+func (w *location) matchDir(q locationQuery, dir storedefs.Dir) (bool, [][2]int, string) {
+	if q.favOnly && !q.favorites[dir.Path] {
+		return false, nil, "not a favorite"
+	}
+	candidate := fsutil.TildeAbbr(dir.Path)
+	if q.zoomRoot != "" {
+		rel, ok := relativeTo(w.resolve(dir.Path), q.zoomRoot)
+		if !ok {
+			return false, nil, "not under " + q.zoomRoot
+		}
+		candidate = rel
+	}
+	if len(q.depthPreds) > 0 {
+		depth := pathDepth(w.resolve(dir.Path))
+		for _, pred := range q.depthPreds {
+			if !pred.match(depth) {
+				return false, nil, fmt.Sprintf("depth %d does not satisfy %s", depth, pred)
+			}
+		}
+	}
+	if ok, highlights := q.match(candidate); ok {
+		return true, highlights, "path matched"
+	}
+	if alias := q.aliases[dir.Path]; alias != "" {
+		if ok, _ := q.match(alias); ok {
+			return true, nil, "alias matched"
+		}
+	}
+	if name, ok := w.projects[dir.Path]; ok {
+		if ok, _ := q.match(name); ok {
+			return true, nil, "project matched"
+		}
+	}
+	if w.spec.MatchSymlinkTargets {
+		if target := w.symlinkTarget(w.resolve(dir.Path)); target != "" {
+			if ok, _ := q.match(fsutil.TildeAbbr(target)); ok {
+				return true, nil, "symlink target matched"
+			}
+		}
+	}
+	return false, nil, "path not matched"
+}
+
+// Marks the directories suggested by LocationNextLikelyStore and moves them just
+// below pinned directories, in the order of the suggestions.
+func (w *location) moveSuggested(entries []locationEntry) {
+	rank := func(e locationEntry) int {
+		if e.Score == pinnedScore {
+			return -1
+		}
+		if r, ok := w.suggested[e.Path]; ok {
+			return r
+		}
+		return len(w.suggested)
+	}
+	for i := range entries {
+		_, entries[i].suggested = w.suggested[entries[i].Path]
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return rank(entries[i]) < rank(entries[j])
+	})
+}
+
+// Sorts the entries according to LocationSpec.EmptyQueryOrder, keeping pinned
+// directories first.
+func (w *location) orderEmptyQuery(entries []locationEntry) {
+	var less func(a, b locationEntry) bool
+	switch w.spec.EmptyQueryOrder {
+	case LocationOrderByRecency:
+		if w.lastVisits == nil {
+			return
+		}
+		less = func(a, b locationEntry) bool {
+			ta, oka := w.lastVisits[a.Path]
+			tb, okb := w.lastVisits[b.Path]
+			return oka && (!okb || ta.After(tb))
+		}
+	case LocationOrderAlphabetically:
+		less = func(a, b locationEntry) bool { return a.Path < b.Path }
+	default:
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.Score == pinnedScore) != (b.Score == pinnedScore) {
+			return a.Score == pinnedScore
+		}
+		return a.Score != pinnedScore && less(a, b)
+	})
+}
+
+// Groups the rows of the list under group headers if grouping by workspace,
+// omitting the directories in collapsed groups. Groups are ordered by their
+// first occurrence.
+func (w *location) group(l locationList) locationList {
+	if w.groups == nil {
+		return l
+	}
+	var order []string
+	members := map[string][]locationEntry{}
+	for _, e := range l.entries {
+		g := w.groups[e.Path]
+		if _, ok := members[g]; !ok {
+			order = append(order, g)
+		}
+		members[g] = append(members[g], e)
+	}
+	collapsed := w.copyState().collapsed
+	grouped := locationList{loc: w, count: l.count, more: l.more,
+		showRanks: l.showRanks, scoreWidth: l.scoreWidth, maxScore: l.maxScore,
+		generation: l.generation, groupSizes: map[string]int{}}
+	for _, g := range order {
+		grouped.groupSizes[g] = len(members[g])
+		grouped.entries = append(grouped.entries, locationEntry{header: g})
+		if !collapsed[g] {
+			grouped.entries = append(grouped.entries, members[g]...)
+		}
+	}
+	return grouped
+}
+
+type locationList struct {
+	loc     *location
+	entries []locationEntry
+	// The number of directories that matched the filter, including those in
+	// collapsed groups.
+	count int
+	// The number of matching directories omitted because of
+	// LocationSpec.Limit.
+	more int
+	// Whether to show match scores computed by LocationSpec.Rank.
+	showRanks bool
+	// The width of the score column.
+	scoreWidth int
+	// The value of location.generation when the list was computed.
+	generation int64
+	// The maximum score of non-pinned directories that matched the filter,
+	// when LocationSpec.HeatmapColoring is set.
+	maxScore float64
+	// When grouping by workspace, the number of directories in each group.
+	groupSizes map[string]int
+}
+
+// A row in the location list, either a directory or a group header.
+type locationEntry struct {
+	storedefs.Dir
+	// The match score computed by LocationSpec.Rank.
+	rank float64
+	// The percentile of the score, when LocationSpec.ShowPercentile is set.
+	percentile int
+	// Byte ranges of the abbreviated path that matched the filter.
+	highlights [][2]int
+	// Whether the directory is shown as likely to be changed to next.
+	suggested bool
+	// The name of the group if this is a group header.
+	header string
+}
+
+// Returns the group name if row i is a group header, or "" otherwise.
+func (l locationList) header(i int) string { return l.entries[i].header }
+
+func (l locationList) isHeader(i int) bool { return l.header(i) != "" }
+
+// Returns the index of the row that is either the header for the given group
+// or has the given path, or -1 if there is no such row.
+func (l locationList) find(header, path string) int {
+	for i, e := range l.entries {
+		if e.header == header && (header != "" || e.Path == path) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the directory with the given path, either as stored or
+// after resolving workspace-relative paths, or -1 if there is no such
+// directory.
+func (l locationList) findPath(path string) int {
+	for i, e := range l.entries {
+		if e.header == "" && (e.Path == path || l.loc.resolve(e.Path) == path) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l locationList) Show(i int) ui.Text {
+	e := l.entries[i]
+	if g := e.header; g != "" {
+		marker := "▾"
+		if l.loc.copyState().collapsed[g] {
+			marker = "▸"
+		}
+		return ui.T(fmt.Sprintf("%s %s (%d)", marker, sanitizeLine(g), l.groupSizes[g]), ui.FgMagenta)
+	}
+	var score string
+	if l.loc.spec.ShowPercentile {
+		score = l.loc.showPercentile(e)
+	} else {
+		score = l.loc.showScore(e.Score, l.scoreWidth)
+	}
+	if l.showRanks {
+		score += fmt.Sprintf(" [%.2f]", e.rank)
+	}
+	for _, c := range l.loc.copyState().columns {
+		score += " " + l.loc.showColumn(c, l.loc.resolve(e.Path))
+	}
+	path := l.loc.showPath(e)
+	if l.loc.spec.HeatmapColoring && e.Score != pinnedScore && l.maxScore > 0 {
+		path = ui.StyleText(path, heatColor(e.Score/l.maxScore))
+	}
+	t := ui.Concat(ui.T(score+" "), path)
+	if l.loc.spec.ShowSymlinkTargets {
+		if target := l.loc.symlinkTarget(l.loc.resolve(e.Path)); target != "" {
+			t = ui.Concat(t, ui.T(" -> "+sanitizeLine(fsutil.TildeAbbr(target))))
+		}
+	}
+	if l.loc.spec.ShowMount {
+		if mount, ok := l.loc.mountPoint(l.loc.resolve(e.Path)); ok {
+			t = ui.Concat(t, ui.T(" ["+sanitizeLine(fsutil.TildeAbbr(mount))+"]", ui.FgMagenta))
+		}
+	}
+	if l.loc.spec.ShowProject {
+		if name, ok := l.loc.projects[e.Path]; ok {
+			t = ui.Concat(t, ui.T(" ["+sanitizeLine(name)+"]", ui.FgGreen))
+		}
+	}
+	if alias := l.loc.copyState().aliases[e.Path]; alias != "" {
+		t = ui.Concat(t, ui.T(" @"+sanitizeLine(alias), ui.FgCyan))
+	}
+	if l.loc.copyState().favorites[e.Path] {
+		t = ui.Concat(t, ui.T(" ★", ui.FgYellow))
+	}
+	if n := l.loc.todayVisits[e.Path]; n > 0 {
+		t = ui.Concat(t, ui.T(fmt.Sprintf(" (%d today)", n), ui.FgYellow))
+	}
+	if expiry, ok := l.loc.expiries[e.Path]; ok {
+		if left := time.Until(expiry); left > 0 {
+			t = ui.Concat(t, ui.T(" (expires in "+HumanDuration(left)+")", ui.FgBrightBlack))
+		} else {
+			t = ui.Concat(t, ui.T(" (expired)", ui.FgBrightBlack))
+		}
+	}
+	if l.loc.wd != "" && l.loc.resolve(e.Path) == l.loc.wd {
+		t = ui.Concat(t, ui.T(" (current)", ui.FgBrightBlack))
+	}
+	if e.suggested {
+		t = ui.Concat(t, ui.T(" (likely next)", ui.FgBrightBlack))
+	}
+	if l.loc.copyState().sticky[e.Path] {
+		t = ui.Concat(t, ui.T(" (sticky)", ui.FgGreen))
+	}
+	if n, ok := l.loc.copyState().childCounts[e.Path]; ok {
+		t = ui.Concat(t, ui.T(fmt.Sprintf(" (%d subdirs)", n), ui.FgBlue))
+	}
+	if clean, ok := l.loc.copyState().gitClean[e.Path]; ok {
+		if clean {
+			t = ui.Concat(t, ui.T(" (git clean)", ui.FgGreen))
+		} else {
+			t = ui.Concat(t, ui.T(" (git dirty)", ui.FgYellow))
+		}
+	}
+	inaccessible := l.loc.spec.MarkInaccessible && l.loc.inaccessible(l.loc.resolve(e.Path))
+	if inaccessible {
+		t = ui.Concat(t, ui.T(" (no access)", ui.FgRed))
+	}
+	if l.loc.old[e.Path] || inaccessible {
+		t = ui.StyleText(t, ui.Dim)
+	}
+	if l.loc.isMarked(e.Path) {
+		t = ui.StyleText(t, ui.Bold)
+	}
+	return t
+}
+
+func (l locationList) Len() int { return len(l.entries) }
+
+// Describes how the entry matched the filter, like "match: 3 chars, contiguous,
+// at 5", or returns "" if there are no highlights to describe. Counts and
+// positions are in characters of the path the filter was matched against.
+func (w *location) matchDetail(l locationList, e locationEntry) string {
+	if len(e.highlights) == 0 {
+		return ""
+	}
+	candidate := fsutil.TildeAbbr(e.Path)
+	if rel, ok := relativeTo(w.resolve(e.Path), w.zoomRoot()); ok {
+		candidate = rel
+	}
+	matched := 0
+	for _, h := range e.highlights {
+		if h[1] > len(candidate) {
+			return ""
+		}
+		matched += utf8.RuneCountInString(candidate[h[0]:h[1]])
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "match: %d chars", matched)
+	if len(e.highlights) == 1 {
+		sb.WriteString(", contiguous")
+	} else {
+		fmt.Fprintf(&sb, " in %d runs", len(e.highlights))
+	}
+	fmt.Fprintf(&sb, ", at %d", utf8.RuneCountInString(candidate[:e.highlights[0][0]]))
+	if w.spec.Rank != nil {
+		fmt.Fprintf(&sb, ", rank %.2f", e.rank)
+	}
+	return sb.String()
+}
+
+// Replaces each byte of control characters and invalid UTF-8 sequences in s
+// with "?", so that paths and annotations from a corrupted store or a
+// misbehaving callback can't garble the terminal. Byte offsets are preserved,
+// so highlights of paths still apply.
+func sanitizeLine(s string) string {
+	clean := true
+	for _, r := range s {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || unicode.IsControl(r) {
+			sb.WriteString(strings.Repeat("?", size))
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return sb.String()
+}
+
+// Shows the path of the entry, with the parts that matched the filter
+// highlighted. Highlights are only shown when the path is shown abbreviated,
+// since they refer to the abbreviated path. If LocationSpec.StyledSeparators
+// is set, path separators are also dimmed and the last component is bold.
+func (w *location) showPath(e locationEntry) ui.Text {
+	path := sanitizeLine(w.displayPath(e.Path))
+	highlights := e.highlights
+	if w.copyState().absolute && w.zoomRoot() == "" {
+		highlights = nil
+	}
+	styled := w.spec.StyledSeparators
+	if len(highlights) == 0 && !styled {
+		return ui.T(path)
+	}
+	// Compute the styling of each byte, and write runs of bytes with the same
+	// styling as segments.
+	underlined := make([]bool, len(path))
+	last := 0
+	for _, h := range highlights {
+		if h[0] < last || h[1] > len(path) {
+			continue
+		}
+		for i := h[0]; i < h[1]; i++ {
+			underlined[i] = true
+		}
+		last = h[1]
+	}
+	leafStart := len(path)
+	if styled {
+		leafStart = strings.LastIndexFunc(path, isPathSeparator) + 1
+	}
+	type byteStyle struct{ dim, bold, underlined bool }
+	styleAt := func(i int) byteStyle {
+		dim := styled && isPathSeparator(rune(path[i]))
+		return byteStyle{dim, !dim && i >= leafStart, underlined[i]}
+	}
+	var t ui.Text
+	start := 0
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && styleAt(i) == styleAt(start) {
+			continue
+		}
+		s := styleAt(start)
+		var stylings []ui.Styling
+		if s.dim {
+			stylings = append(stylings, ui.Dim)
+		}
+		if s.bold {
+			stylings = append(stylings, ui.Bold)
+		}
+		if s.underlined {
+			stylings = append(stylings, ui.Underlined)
+		}
+		t = ui.Concat(t, ui.T(path[start:i], stylings...))
+		start = i
+	}
+	return t
+}
+
+// Colors of the heatmap, from the least visited directories to the most
+// visited ones.
+var heatColors = []ui.Styling{ui.FgBlue, ui.FgCyan, ui.FgGreen, ui.FgYellow, ui.FgRed}
+
+// Returns the heatmap color for a score relative to the maximum score, which
+// is between 0 and 1.
+func heatColor(relative float64) ui.Styling {
+	i := int(math.Round(relative * float64(len(heatColors)-1)))
+	if i < 0 {
+		i = 0
+	} else if i >= len(heatColors) {
+		i = len(heatColors) - 1
+	}
+	return heatColors[i]
+}
+
+// Minimum width of the score column; it is wider if the pinned marker or any
+// formatted score is.
+const scoreWidth = 3
+
+func (w *location) pinnedMarker() string {
+	if w.spec.PinnedMarker == "" {
+		return "*"
+	}
+	return w.spec.PinnedMarker
+}
+
+func (w *location) showScore(f float64, width int) string {
+	if f == pinnedScore {
+		return w.padScore(w.pinnedMarker(), width)
+	}
+	return w.padScore(w.formatScore(f), width)
+}
+
+func (w *location) formatScore(f float64) string {
+	if w.spec.ScoreFormat != nil {
+		return w.spec.ScoreFormat(f)
+	}
+	return fmt.Sprintf("%.0f", f)
+}
+
+// Returns the width of the score column needed for the entries.
+func (w *location) scoreColumnWidth(entries []locationEntry) int {
+	width := scoreWidth
+	for _, e := range entries {
+		if e.header == "" && e.Score != pinnedScore {
+			if sw := wcwidth.Of(w.formatScore(e.Score)); sw > width {
+				width = sw
+			}
+		}
+	}
+	return width
+}
+
+// Width of the score column when showing percentiles, enough for "100%".
+const percentileWidth = 4
+
+func (w *location) showPercentile(e locationEntry) string {
+	s := fmt.Sprintf("%d%%", e.percentile)
+	if e.Score == pinnedScore {
+		s = w.pinnedMarker()
+	}
+	return w.padScore(s, percentileWidth)
+}
+
+// Pads s to the given width, or the width of the pinned marker if it is
+// wider.
+func (w *location) padScore(s string, width int) string {
+	if markerWidth := wcwidth.Of(w.pinnedMarker()); markerWidth > width {
+		width = markerWidth
+	}
+	if pad := width - wcwidth.Of(s); pad > 0 {
+		s = strings.Repeat(" ", pad) + s
+	}
+	return s
+}
+
+// Sets the percentile of each non-pinned entry to the percentage of non-pinned
+// entries whose scores are not higher than its score, rounded to the nearest
+// integer.
+func computePercentiles(entries []locationEntry) {
+	var scores []float64
+	for _, e := range entries {
+		if e.Score != pinnedScore {
+			scores = append(scores, e.Score)
+		}
+	}
+	sort.Float64s(scores)
+	for i, e := range entries {
+		if e.Score == pinnedScore {
+			continue
+		}
+		notHigher := sort.Search(len(scores), func(j int) bool { return scores[j] > e.Score })
+		entries[i].percentile = int(math.Round(100 * float64(notHigher) / float64(len(scores))))
+	}
+}
@@ -0,0 +1,307 @@
+package modes
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// LocationMatcher matches the filter of the location mode against candidates,
+// which are abbreviated paths or aliases of directories.
+type LocationMatcher interface {
+	// Match returns whether the candidate matches the query, and the byte
+	// ranges of the candidate that matched, each as a [start, end) pair in
+	// ascending order.
+	Match(query, candidate string) (matched bool, highlights [][2]int)
+}
+
+// Returns a function that matches candidates against the filter, using
+// LocationSpec.Matcher if it is set and a FilterMatcher wrapping
+// LocationSpec.Filter otherwise.
+func (w *location) matcher(p string) func(string) (bool, [][2]int) {
+	m := w.spec.Matcher
+	if cycle := w.spec.MatcherCycle; len(cycle) > 0 {
+		m = cycle[w.copyState().matcher]
+	}
+	if m == nil {
+		m = &FilterMatcher{Filter: w.spec.Filter}
+	}
+	return func(s string) (bool, [][2]int) { return m.Match(p, s) }
+}
+
+// CycleMatcher switches to the next matcher in LocationSpec.MatcherCycle.
+func (w *location) CycleMatcher() {
+	n := len(w.spec.MatcherCycle)
+	if n == 0 {
+		return
+	}
+	w.mutateState(func(s *locationState) { s.matcher = (s.matcher + 1) % n })
+	w.refresh()
+}
+
+// Returns the name of a matcher, which is the result of its String method if
+// it has one, and derived from its type otherwise; for example, the name of
+// SubstringMatcher is "substring".
+func matcherName(m LocationMatcher) string {
+	if s, ok := m.(fmt.Stringer); ok {
+		return s.String()
+	}
+	name := fmt.Sprintf("%T", m)
+	name = name[strings.LastIndexByte(name, '.')+1:]
+	name = strings.TrimSuffix(name, "Matcher")
+	if name == "" {
+		return "matcher"
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// FilterMatcher is the LocationMatcher used when LocationSpec.Matcher is nil.
+// It matches candidates with the predicate made by Filter, which does a
+// substring match if Filter.Maker is nil.
+type FilterMatcher struct {
+	Filter FilterSpec
+
+	mutex sync.Mutex
+	query string
+	pred  func(string) bool
+}
+
+// Match implements LocationMatcher. Since the predicate can't report what it
+// matched, it highlights the first occurrence of each whitespace-separated
+// segment of the query instead, ignoring case if the segment is in lower case
+// like the filter of Elvish's editor does. Segments that don't occur in the
+// candidate as is, like parts of filter expressions, are not highlighted.
+func (m *FilterMatcher) Match(query, candidate string) (bool, [][2]int) {
+	if !m.predicate(query)(candidate) {
+		return false, nil
+	}
+	var highlights [][2]int
+	for _, segment := range strings.Fields(query) {
+		haystack := candidate
+		if segment == strings.ToLower(segment) {
+			if lower := strings.ToLower(candidate); len(lower) == len(candidate) {
+				haystack = lower
+			}
+		}
+		if i := strings.Index(haystack, segment); i != -1 {
+			highlights = append(highlights, [2]int{i, i + len(segment)})
+		}
+	}
+	return true, mergeRanges(highlights)
+}
+
+// Makes the predicate for the query, reusing the last result if the query is
+// the same.
+func (m *FilterMatcher) predicate(query string) func(string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.pred == nil || m.query != query {
+		m.query = query
+		m.pred = m.Filter.makePredicate(query)
+	}
+	return m.pred
+}
+
+// SubstringMatcher matches candidates that contain the query.
+type SubstringMatcher struct{}
+
+// Match implements LocationMatcher. It highlights the first occurrence of the
+// query.
+func (SubstringMatcher) Match(query, candidate string) (bool, [][2]int) {
+	if query == "" {
+		return true, nil
+	}
+	i := strings.Index(candidate, query)
+	if i == -1 {
+		return false, nil
+	}
+	return true, [][2]int{{i, i + len(query)}}
+}
+
+// SubsequenceMatcher matches candidates that contain all the characters of the
+// query in order, but not necessarily adjacently.
+type SubsequenceMatcher struct{}
+
+// Match implements LocationMatcher. It highlights the earliest occurrence of
+// each character of the query.
+func (SubsequenceMatcher) Match(query, candidate string) (bool, [][2]int) {
+	var highlights [][2]int
+	i := 0
+	for _, r := range query {
+		j := strings.IndexRune(candidate[i:], r)
+		if j == -1 {
+			return false, nil
+		}
+		start := i + j
+		i = start + utf8.RuneLen(r)
+		highlights = appendRange(highlights, start, i)
+	}
+	return true, highlights
+}
+
+// RegexpMatcher matches candidates against the query interpreted as a regular
+// expression. Queries that are not valid regular expressions match nothing.
+type RegexpMatcher struct {
+	mutex sync.Mutex
+	query string
+	re    *regexp.Regexp
+}
+
+// Match implements LocationMatcher. It highlights the leftmost match.
+func (m *RegexpMatcher) Match(query, candidate string) (bool, [][2]int) {
+	re := m.compile(query)
+	if re == nil {
+		return false, nil
+	}
+	loc := re.FindStringIndex(candidate)
+	if loc == nil {
+		return false, nil
+	}
+	if loc[0] == loc[1] {
+		return true, nil
+	}
+	return true, [][2]int{{loc[0], loc[1]}}
+}
+
+// Compiles the query, reusing the last result if the query is the same.
+func (m *RegexpMatcher) compile(query string) *regexp.Regexp {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.re == nil || m.query != query {
+		m.query = query
+		m.re, _ = regexp.Compile(query)
+	}
+	return m.re
+}
+
+// InitialsMatcher matches candidates whose path components start with the
+// characters of the query in order; for example, "ues" matches
+// "/usr/elvish/src". Components are separated by path separators, "-", "_"
+// and ".".
+type InitialsMatcher struct{}
+
+// Match implements LocationMatcher. It highlights the matched initials.
+func (InitialsMatcher) Match(query, candidate string) (bool, [][2]int) {
+	var highlights [][2]int
+	rest := query
+	atStart := true
+	for i, r := range candidate {
+		if isComponentSeparator(r) {
+			atStart = true
+			continue
+		}
+		if atStart && rest != "" {
+			q, size := utf8.DecodeRuneInString(rest)
+			if q == r {
+				rest = rest[size:]
+				highlights = appendRange(highlights, i, i+utf8.RuneLen(r))
+			}
+		}
+		atStart = false
+	}
+	if rest != "" {
+		return false, nil
+	}
+	return true, highlights
+}
+
+// TokenMatcher splits the query into whitespace-separated terms, and matches
+// candidates that match all of them. Terms can use the following forms:
+//
+//   - "^foo" matches a path component that starts with "foo".
+//   - "foo$" matches a path component that ends with "foo".
+//   - "'foo" matches the exact substring "foo".
+//
+// Other terms are matched with Fuzzy, or SubsequenceMatcher if it is nil.
+type TokenMatcher struct {
+	Fuzzy LocationMatcher
+}
+
+// Match implements LocationMatcher. It highlights the matches of all the terms.
+func (m TokenMatcher) Match(query, candidate string) (bool, [][2]int) {
+	var highlights [][2]int
+	for _, term := range strings.Fields(query) {
+		ok, h := m.matchTerm(term, candidate)
+		if !ok {
+			return false, nil
+		}
+		highlights = append(highlights, h...)
+	}
+	return true, mergeRanges(highlights)
+}
+
+func (m TokenMatcher) matchTerm(term, candidate string) (bool, [][2]int) {
+	switch {
+	case strings.HasPrefix(term, "'") && len(term) > 1:
+		return SubstringMatcher{}.Match(term[1:], candidate)
+	case strings.HasPrefix(term, "^") && len(term) > 1:
+		return matchComponent(candidate, term[1:], false)
+	case strings.HasSuffix(term, "$") && len(term) > 1:
+		return matchComponent(candidate, term[:len(term)-1], true)
+	}
+	fuzzy := m.Fuzzy
+	if fuzzy == nil {
+		fuzzy = SubsequenceMatcher{}
+	}
+	return fuzzy.Match(term, candidate)
+}
+
+// Finds the first path component of candidate that starts with s, or ends
+// with s if suffix is true, and returns the range of s within it.
+func matchComponent(candidate, s string, suffix bool) (bool, [][2]int) {
+	start := 0
+	for start <= len(candidate) {
+		end := strings.IndexFunc(candidate[start:], isPathSeparator)
+		if end == -1 {
+			end = len(candidate)
+		} else {
+			end += start
+		}
+		c := candidate[start:end]
+		if !suffix && strings.HasPrefix(c, s) {
+			return true, [][2]int{{start, start + len(s)}}
+		} else if suffix && strings.HasSuffix(c, s) {
+			return true, [][2]int{{end - len(s), end}}
+		}
+		start = end + 1
+	}
+	return false, nil
+}
+
+func isPathSeparator(r rune) bool {
+	return r == filepath.Separator || r == '/'
+}
+
+// Sorts the ranges and merges the ones that overlap or are adjacent.
+func mergeRanges(ranges [][2]int) [][2]int {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var merged [][2]int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func isComponentSeparator(r rune) bool {
+	return isPathSeparator(r) || r == '-' || r == '_' || r == '.'
+}
+
+// Appends the range [start, end) to highlights, merging it with the last
+// range if they are adjacent.
+func appendRange(highlights [][2]int, start, end int) [][2]int {
+	if n := len(highlights); n > 0 && highlights[n-1][1] == start {
+		highlights[n-1][1] = end
+		return highlights
+	}
+	return append(highlights, [2]int{start, end})
+}
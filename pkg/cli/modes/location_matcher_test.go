@@ -0,0 +1,345 @@
+package modes
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/tt"
+	"src.elv.sh/pkg/ui"
+	"src.elv.sh/pkg/wcwidth"
+)
+
+type ranges = [][2]int
+
+func TestSubstringMatcher(t *testing.T) {
+	tt.Test(t, tt.Fn("Match", SubstringMatcher{}.Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		Args("bin", "/usr/bin").Rets(true, ranges{{5, 8}}),
+		Args("u", "/usr/lib/u").Rets(true, ranges{{1, 2}}),
+		Args("lib", "/usr/bin").Rets(false, ranges(nil)),
+	})
+}
+
+func TestSubsequenceMatcher(t *testing.T) {
+	tt.Test(t, tt.Fn("Match", SubsequenceMatcher{}.Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		Args("ub", "/usr/bin").Rets(true, ranges{{1, 2}, {5, 6}}),
+		Args("bin", "/usr/bin").Rets(true, ranges{{5, 8}}),
+		Args("bu", "/usr/bin").Rets(false, ranges(nil)),
+		Args("é", "/café").Rets(true, ranges{{4, 6}}),
+	})
+}
+
+func TestRegexpMatcher(t *testing.T) {
+	m := &RegexpMatcher{}
+	tt.Test(t, tt.Fn("Match", m.Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		Args("b.n$", "/usr/bin").Rets(true, ranges{{5, 8}}),
+		Args("^/u", "/usr/bin").Rets(true, ranges{{0, 2}}),
+		Args("^bin", "/usr/bin").Rets(false, ranges(nil)),
+		Args("[", "/usr/bin").Rets(false, ranges(nil)),
+	})
+}
+
+func TestInitialsMatcher(t *testing.T) {
+	tt.Test(t, tt.Fn("Match", InitialsMatcher{}.Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		Args("ues", "/usr/elvish/src").Rets(true, ranges{{1, 2}, {5, 6}, {12, 13}}),
+		Args("mp", "~/my-proj").Rets(true, ranges{{2, 3}, {5, 6}}),
+		Args("us", "/usr/elvish/src").Rets(true, ranges{{1, 2}, {12, 13}}),
+		Args("su", "/usr/elvish/src").Rets(false, ranges(nil)),
+	})
+}
+
+func TestFilterMatcher(t *testing.T) {
+	tt.Test(t, tt.Fn("Match", (&FilterMatcher{}).Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		Args("bin", "/usr/bin").Rets(true, ranges{{5, 8}}),
+		Args("lib", "/usr/bin").Rets(false, ranges(nil)),
+	})
+
+	// A filter like the one of Elvish's editor, which matches words in any
+	// order, ignoring case for words in lower case.
+	segments := FilterSpec{Maker: func(p string) func(string) bool {
+		return func(s string) bool {
+			for _, word := range strings.Fields(p) {
+				if word == strings.ToLower(word) {
+					s = strings.ToLower(s)
+				}
+				if !strings.Contains(s, word) {
+					return false
+				}
+			}
+			return true
+		}
+	}}
+	tt.Test(t, tt.Fn("Match", (&FilterMatcher{Filter: segments}).Match), tt.Table{
+		Args("bin u", "/usr/bin").Rets(true, ranges{{1, 2}, {5, 8}}),
+		Args("us sr", "/usr/bin").Rets(true, ranges{{1, 4}}),
+		Args("src", "/opt/Src").Rets(true, ranges{{5, 8}}),
+		Args("Src", "/opt/src").Rets(false, ranges(nil)),
+	})
+
+	// Segments that the predicate matches in other ways are not highlighted.
+	always := FilterSpec{Maker: func(string) func(string) bool {
+		return func(string) bool { return true }
+	}}
+	tt.Test(t, tt.Fn("Match", (&FilterMatcher{Filter: always}).Match), tt.Table{
+		Args("(re b.n)", "/usr/bin").Rets(true, ranges(nil)),
+	})
+}
+
+func TestLocation_DefaultMatcher_Highlights(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+	}
+	startLocation(f.App, LocationSpec{Store: locationStore{storedDirs: dirs}})
+
+	feedInput(f.TTY, "bin")
+	f.TTY.TestBuffer(t, locationRowsBuf("bin", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr/")), ui.T("bin", ui.Underlined))))
+}
+
+// A custom matcher that matches candidates with the query as a suffix.
+type suffixMatcher struct{}
+
+func (suffixMatcher) Match(query, candidate string) (bool, [][2]int) {
+	if len(query) > len(candidate) || candidate[len(candidate)-len(query):] != query {
+		return false, nil
+	}
+	return true, [][2]int{{len(candidate) - len(query), len(candidate)}}
+}
+
+func TestTokenMatcher(t *testing.T) {
+	tt.Test(t, tt.Fn("Match", TokenMatcher{}.Match), tt.Table{
+		Args("", "/usr/bin").Rets(true, ranges(nil)),
+		// Prefix of a component.
+		Args("^bi", "/usr/bin").Rets(true, ranges{{5, 7}}),
+		Args("^sr", "/usr/bin").Rets(false, ranges(nil)),
+		// Suffix of a component.
+		Args("sr$", "/usr/bin").Rets(true, ranges{{2, 4}}),
+		Args("bi$", "/usr/bin").Rets(false, ranges(nil)),
+		// Exact substring.
+		Args("'r/b", "/usr/bin").Rets(true, ranges{{3, 6}}),
+		Args("'ub", "/usr/bin").Rets(false, ranges(nil)),
+		// Other terms are fuzzy.
+		Args("ub", "/usr/bin").Rets(true, ranges{{1, 2}, {5, 6}}),
+		// All terms must match; highlights are merged.
+		Args("^us in$", "/usr/bin").Rets(true, ranges{{1, 3}, {6, 8}}),
+		Args("^us 'sr", "/usr/bin").Rets(true, ranges{{1, 4}}),
+		Args("^us ^lib", "/usr/bin").Rets(false, ranges(nil)),
+		// Lone anchors are fuzzy terms.
+		Args("^", "/usr/bin").Rets(false, ranges(nil)),
+		Args("$", "/a$b").Rets(true, ranges{{2, 3}}),
+	})
+	tt.Test(t, tt.Fn("Match", TokenMatcher{Fuzzy: SubstringMatcher{}}.Match), tt.Table{
+		Args("ub", "/usr/bin").Rets(false, ranges(nil)),
+		Args("sr ^b", "/usr/bin").Rets(true, ranges{{2, 4}, {5, 6}}),
+	})
+}
+
+func TestLocation_StyledSeparators(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: []storedefs.Dir{
+			{Path: fixPath("/usr/bin"), Score: 200},
+			{Path: fixPath("/tmp"), Score: 100}}},
+		Matcher:          SubstringMatcher{},
+		StyledSeparators: true,
+	})
+	sep := string(filepath.Separator)
+	vol := filepath.VolumeName(fixPath("/"))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+vol), ui.T(sep, ui.Dim), ui.T("usr"), ui.T(sep, ui.Dim),
+			ui.T("bin", ui.Bold)),
+		ui.Concat(ui.T("100 "+vol), ui.T(sep, ui.Dim), ui.T("tmp", ui.Bold))))
+
+	// Highlights are combined with the styles.
+	f.TTY.Inject(term.K('r'), term.K(filepath.Separator), term.K('b'))
+	f.TTY.TestBuffer(t, locationRowsBuf("r"+sep+"b", 0,
+		ui.Concat(ui.T("200 "+vol), ui.T(sep, ui.Dim), ui.T("us"), ui.T("r", ui.Underlined),
+			ui.T(sep, ui.Dim, ui.Underlined), ui.T("b", ui.Bold, ui.Underlined),
+			ui.T("in", ui.Bold))))
+}
+
+func TestLocation_Matcher(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/bin/usr"), Score: 100},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs}, Matcher: suffixMatcher{}})
+
+	f.TTY.Inject(term.K('b'), term.K('i'), term.K('n'))
+	f.TTY.TestBuffer(t, locationRowsBuf("bin", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr/")), ui.T("bin", ui.Underlined))))
+}
+
+func TestLocation_Matcher_HighlightsNotShownForAbsolutePaths(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:   locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/usr/bin"), Score: 200}}},
+		Matcher: SubstringMatcher{},
+	})
+	startMode(f.App, w, err)
+	w.ToggleAbsolute()
+	f.TTY.Inject(term.K('b'))
+	f.TTY.TestBuffer(t, locationRowsBuf("b", 0, ui.T("200 "+fixPath("/usr/bin"))))
+}
+
+func TestLocation_ShowMatchDetail(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: []storedefs.Dir{
+			{Path: fixPath("/usr/bin"), Score: 200},
+			{Path: fixPath("/tmp"), Score: 100}}},
+		Matcher:         SubsequenceMatcher{},
+		ShowMatchDetail: true,
+	})
+	vol := len(fixPath("/")) - 1
+	// No detail when nothing is highlighted.
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/tmp"))))
+
+	f.TTY.Inject(term.K('u'), term.K('b'))
+	f.TTY.TestBuffer(t, locationRowsBuf("ub", 0,
+		ui.Concat(ui.T("200 "+fixPath("/")), ui.T("u", ui.Underlined), ui.T("sr"+string(filepath.Separator)),
+			ui.T("b", ui.Underlined), ui.T("in")),
+		ui.T(fmt.Sprintf("match: 2 chars in 2 runs, at %d", vol+1), ui.Dim)))
+
+	f.TTY.Inject(term.K(ui.Backspace), term.K(ui.Backspace), term.K('b'), term.K('i'))
+	f.TTY.TestBuffer(t, locationRowsBuf("bi", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr/")), ui.T("bi", ui.Underlined), ui.T("n")),
+		ui.T(fmt.Sprintf("match: 2 chars, contiguous, at %d", vol+5), ui.Dim)))
+}
+
+func TestLocation_ShowMatchDetail_WithRank(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:           locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 100}}},
+		Matcher:         SubstringMatcher{},
+		Rank:            func(string, string) float64 { return 1.5 },
+		ShowMatchDetail: true,
+	})
+	vol := len(fixPath("/")) - 1
+	f.TTY.Inject(term.K('t'), term.K('m'))
+	f.TTY.TestBuffer(t, locationRowsBuf("tm", 0,
+		ui.Concat(ui.T("100 "+fixPath("/")), ui.T("tm", ui.Underlined), ui.T("p")),
+		ui.T(fmt.Sprintf("match: 2 chars, contiguous, at %d, rank 1.50", vol+1), ui.Dim)))
+}
+
+func TestLocation_RichPrompt(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:           locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/usr"), Score: 200}}},
+		MatcherCycle:    []LocationMatcher{SubstringMatcher{}, SubsequenceMatcher{}},
+		EmptyQueryOrder: LocationOrderAlphabetically,
+		RichPrompt:      true,
+	})
+	startMode(f.App, w, err)
+	testPrompt := func(label, status, row string) {
+		t.Helper()
+		f.TTY.TestBuffer(t, term.NewBufferBuilder(50).
+			Newline(). // empty code area
+			WriteStyled(modeLine(label, true)).SetDotHere().
+			Write(strings.Repeat(" ", 50-wcwidth.Of(label)-1-len(status))+status).
+			Newline().WriteStyled(ui.T(fmt.Sprintf("%-50s", row), ui.Inverse)).
+			Buffer())
+	}
+	testPrompt(" LOCATION [substring·alpha] ", "[substring]", "200 "+fixPath("/usr"))
+
+	w.CycleMatcher()
+	testPrompt(" LOCATION [subsequence·alpha] ", "[subsequence]", "200 "+fixPath("/usr"))
+
+	w.ToggleAbsolute()
+	testPrompt(" LOCATION [subsequence·alpha·abs] ", "[subsequence]", "200 "+fixPath("/usr"))
+}
+
+func TestLocation_RichPrompt_Off(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:   locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/usr"), Score: 200}}},
+		Matcher: SubstringMatcher{},
+	})
+	startMode(f.App, w, err)
+	w.ToggleAbsolute()
+	f.TTY.TestBuffer(t, locationBuf("", "200 "+fixPath("/usr")))
+}
+
+func TestMatcherName(t *testing.T) {
+	tt.Test(t, tt.Fn("matcherName", matcherName), tt.Table{
+		Args(SubstringMatcher{}).Rets("substring"),
+		Args(&RegexpMatcher{}).Rets("regexp"),
+		Args(TokenMatcher{}).Rets("token"),
+		Args(suffixMatcher{}).Rets("suffix"),
+		Args(namedMatcher{name: "custom"}).Rets("custom"),
+	})
+}
+
+// A matcher with a name, which doesn't highlight matches.
+type namedMatcher struct {
+	name  string
+	match func(query, candidate string) bool
+}
+
+func (m namedMatcher) Match(query, candidate string) (bool, [][2]int) {
+	return m.match(query, candidate), nil
+}
+
+func (m namedMatcher) String() string { return m.name }
+
+func TestLocation_CycleMatcher(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/opt/usr"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		MatcherCycle: []LocationMatcher{
+			namedMatcher{"prefix", func(q, c string) bool {
+				return strings.HasPrefix(c, fixPath("/"+q))
+			}},
+			namedMatcher{"suffix", func(q, c string) bool {
+				return strings.HasSuffix(c, q)
+			}},
+		},
+	})
+	startMode(f.App, w, err)
+	feedInput(f.TTY, "usr")
+	f.TTY.TestBuffer(t, locationStatusBuf("usr", "[prefix]", "200 "+fixPath("/usr/bin")))
+
+	w.CycleMatcher()
+	f.TTY.TestBuffer(t, locationStatusBuf("usr", "[suffix]", " 50 "+fixPath("/opt/usr")))
+
+	// Cycling wraps around.
+	w.CycleMatcher()
+	f.TTY.TestBuffer(t, locationStatusBuf("usr", "[prefix]", "200 "+fixPath("/usr/bin")))
+}
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package modes
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// Returns the mount point of the filesystem dir is on, found by walking up
+// from dir until the device ID changes. It returns false if the device IDs are
+// not available, or if the MaxStats budget is exhausted before the mount point
+// is found.
+func (w *location) mountPoint(dir string) (string, bool) {
+	dev, ok := w.deviceOf(dir)
+	if !ok {
+		return "", false
+	}
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, true
+		}
+		parentDev, ok := w.deviceOf(parent)
+		if !ok {
+			return "", false
+		}
+		if parentDev != dev {
+			return dir, true
+		}
+		dir = parent
+	}
+}
+
+func (w *location) deviceOf(dir string) (uint64, bool) {
+	r, ok := w.stats.Stat(dir)
+	if !ok || r.err != nil {
+		return 0, false
+	}
+	st, ok := r.info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
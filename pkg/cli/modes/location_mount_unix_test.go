@@ -0,0 +1,79 @@
+//go:build !windows && !plan9
+
+package modes
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+// A fake os.FileInfo with a device ID.
+type devInfo struct {
+	fileInfo
+	dev uint64
+}
+
+func (fi devInfo) Sys() any {
+	var st syscall.Stat_t
+	setDev(&st.Dev, fi.dev)
+	return &st
+}
+
+// Sets the device ID field of syscall.Stat_t, whose type differs between
+// operating systems: for example, it is int32 on Darwin and OpenBSD and uint64
+// on Linux.
+func setDev[T int32 | uint32 | uint64](p *T, dev uint64) { *p = T(dev) }
+
+var mountTestDirs = []storedefs.Dir{
+	{Path: "/usr/bin", Score: 200},
+	{Path: "/mnt/nas/photos", Score: 100},
+	{Path: "/opt", Score: 50},
+}
+
+func statWithDevices(path string) (os.FileInfo, error) {
+	devs := map[string]uint64{
+		"/": 1, "/usr": 1, "/usr/bin": 1, "/mnt": 1, "/mnt/nas": 2, "/mnt/nas/photos": 2}
+	if dev, ok := devs[path]; ok {
+		return devInfo{dev: dev}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestLocation_ShowMount(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:     locationStore{storedDirs: mountTestDirs},
+		ShowMount: true,
+		Stat:      statWithDevices,
+	})
+	// Directories whose mount point can't be determined have no tag.
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 /usr/bin"), ui.T(" [/]", ui.FgMagenta)),
+		ui.Concat(ui.T("100 /mnt/nas/photos"), ui.T(" [/mnt/nas]", ui.FgMagenta)),
+		ui.T(" 50 /opt")))
+}
+
+func TestLocation_GroupByMount(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:        locationStore{storedDirs: mountTestDirs},
+		GroupByMount: true,
+		Stat:         statWithDevices,
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("▾ / (1)", ui.FgMagenta),
+		ui.T("200 /usr/bin"),
+		ui.T("▾ /mnt/nas (1)", ui.FgMagenta),
+		ui.T("100 /mnt/nas/photos"),
+		ui.T("▾ Other (1)", ui.FgMagenta),
+		ui.T(" 50 /opt")))
+}
@@ -0,0 +1,10 @@
+package modes
+
+import "path/filepath"
+
+// Returns the drive or UNC share dir is on, which is good enough to tell
+// filesystems apart on Windows.
+func (w *location) mountPoint(dir string) (string, bool) {
+	vol := filepath.VolumeName(dir)
+	return vol, vol != ""
+}
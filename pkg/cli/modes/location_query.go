@@ -0,0 +1,97 @@
+package modes
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Trims leading and trailing whitespace from the filter and collapses internal
+// runs of whitespace into single spaces, so that accidental spaces don't
+// change the result regardless of the matcher.
+func normalizeQuery(filter string) string {
+	return strings.Join(strings.Fields(filter), " ")
+}
+
+var depthTokenRegexp = regexp.MustCompile(`^depth([<>=])(\d+)$`)
+
+// A predicate on the depth of a directory, parsed from a token like "depth>3".
+type depthPredicate struct {
+	op    byte
+	depth int
+}
+
+func (p depthPredicate) String() string {
+	return fmt.Sprintf("depth%c%d", p.op, p.depth)
+}
+
+func (p depthPredicate) match(depth int) bool {
+	switch p.op {
+	case '<':
+		return depth < p.depth
+	case '>':
+		return depth > p.depth
+	default:
+		return depth == p.depth
+	}
+}
+
+// Extracts tokens like "depth>3", "depth<2" and "depth=1" from the filter,
+// returning the rest of the filter and the parsed predicates. The filter is
+// returned unchanged if it has no such tokens.
+func parseDepthTokens(filter string) (string, []depthPredicate) {
+	var rest []string
+	var preds []depthPredicate
+	for _, field := range strings.Fields(filter) {
+		m := depthTokenRegexp.FindStringSubmatch(field)
+		if m == nil {
+			rest = append(rest, field)
+			continue
+		}
+		depth, err := strconv.Atoi(m[2])
+		if err != nil {
+			// Too large to be a depth.
+			rest = append(rest, field)
+			continue
+		}
+		preds = append(preds, depthPredicate{m[1][0], depth})
+	}
+	if len(preds) == 0 {
+		return filter, nil
+	}
+	return strings.Join(rest, " "), preds
+}
+
+// The token in the filter that restricts the directories to favorite ones.
+const favToken = "@fav"
+
+// Removes "@fav" tokens from the filter, returning the rest of the filter and
+// whether there was such a token. The filter is returned unchanged if it has
+// no such token.
+func parseFavToken(filter string) (string, bool) {
+	fields := strings.Fields(filter)
+	rest := fields[:0]
+	for _, field := range fields {
+		if field != favToken {
+			rest = append(rest, field)
+		}
+	}
+	if len(rest) == len(fields) {
+		return filter, false
+	}
+	return strings.Join(rest, " "), true
+}
+
+// Returns the number of components of an absolute path; the root directory
+// has depth 0.
+func pathDepth(path string) int {
+	path = filepath.Clean(path)
+	path = path[len(filepath.VolumeName(path)):]
+	path = strings.Trim(path, string(filepath.Separator))
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, string(filepath.Separator)) + 1
+}
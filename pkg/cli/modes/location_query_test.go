@@ -0,0 +1,124 @@
+package modes
+
+import (
+	"reflect"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/tt"
+	"src.elv.sh/pkg/ui"
+)
+
+type depthPreds = []depthPredicate
+
+func TestNormalizeQuery(t *testing.T) {
+	tt.Test(t, tt.Fn("normalizeQuery", normalizeQuery), tt.Table{
+		Args("").Rets(""),
+		Args("   ").Rets(""),
+		Args(" foo ").Rets("foo"),
+		Args("foo  \t bar ").Rets("foo bar"),
+	})
+}
+
+func TestLocation_NormalizesQuery(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/my dir"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	matchers := []struct {
+		name    string
+		matcher LocationMatcher
+	}{
+		{"default", nil},
+		{"substring", SubstringMatcher{}},
+		{"subsequence", SubsequenceMatcher{}},
+	}
+	for _, m := range matchers {
+		t.Run(m.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+			w, err := NewLocation(f.App, LocationSpec{
+				Store: locationStore{storedDirs: dirs}, Matcher: m.matcher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range []struct {
+				query string
+				want  []string
+			}{
+				{"  tmp  ", []string{fixPath("/tmp")}},
+				{"my   dir ", []string{fixPath("/my dir")}},
+				{"   ", []string{fixPath("/usr/bin"), fixPath("/my dir"), fixPath("/tmp")}},
+			} {
+				var got []string
+				for _, e := range w.(*location).filter(test.query).entries {
+					got = append(got, e.Path)
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("filter %q: got %v, want %v", test.query, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDepthTokens(t *testing.T) {
+	tt.Test(t, tt.Fn("parseDepthTokens", parseDepthTokens), tt.Table{
+		Args("").Rets("", depthPreds(nil)),
+		Args("foo  bar").Rets("foo  bar", depthPreds(nil)),
+		Args("depth>3").Rets("", depthPreds{{'>', 3}}),
+		Args("foo depth<2 bar").Rets("foo bar", depthPreds{{'<', 2}}),
+		Args("depth=1 depth>0").Rets("", depthPreds{{'=', 1}, {'>', 0}}),
+		Args("depth>x depth!1").Rets("depth>x depth!1", depthPreds(nil)),
+	})
+}
+
+func TestParseFavToken(t *testing.T) {
+	tt.Test(t, tt.Fn("parseFavToken", parseFavToken), tt.Table{
+		Args("").Rets("", false),
+		Args("foo  bar").Rets("foo  bar", false),
+		Args("@fav").Rets("", true),
+		Args("foo @fav bar").Rets("foo bar", true),
+		Args("@favorite").Rets("@favorite", false),
+	})
+}
+
+func TestPathDepth(t *testing.T) {
+	tt.Test(t, tt.Fn("pathDepth", pathDepth), tt.Table{
+		Args(fixPath("/")).Rets(0),
+		Args(fixPath("/usr")).Rets(1),
+		Args(fixPath("/usr/local/bin/")).Rets(3),
+	})
+}
+
+func TestLocation_DepthTokens(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/local/bin"), Score: 200},
+		{Path: fixPath("/usr/bin"), Score: 150},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/bin"), Score: 50},
+	}
+	tests := []struct {
+		filter string
+		rows   []ui.Text
+	}{
+		{"depth>2", []ui.Text{ui.T("200 " + fixPath("/usr/local/bin"))}},
+		{"depth<2", []ui.Text{ui.T("100 " + fixPath("/usr")), ui.T(" 50 " + fixPath("/bin"))}},
+		{"depth=2", []ui.Text{ui.T("150 " + fixPath("/usr/bin"))}},
+		{"bin depth<3", []ui.Text{
+			matchedRow("150 ", fixPath("/usr/bin"), "bin"), matchedRow(" 50 ", fixPath("/bin"), "bin")}},
+		{"depth>1 depth<3", []ui.Text{ui.T("150 " + fixPath("/usr/bin"))}},
+	}
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{Store: locationStore{storedDirs: dirs}})
+			feedInput(f.TTY, test.filter)
+			f.TTY.TestBuffer(t, locationRowsBuf(test.filter, 0, test.rows...))
+		})
+	}
+}
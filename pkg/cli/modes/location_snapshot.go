@@ -0,0 +1,55 @@
+package modes
+
+import (
+	"sync/atomic"
+
+	"src.elv.sh/pkg/store/storedefs"
+)
+
+// LocationSnapshot is an immutable copy of the directories shown by the
+// location mode, in the order they are shown. It can be used to page through
+// the directories without them shifting, and becomes stale when the shown
+// directories change, for example when the filter or an option changes.
+type LocationSnapshot struct {
+	dirs       []storedefs.Dir
+	generation int64
+	current    *int64
+}
+
+// Len returns the number of directories in the snapshot.
+func (s LocationSnapshot) Len() int { return len(s.dirs) }
+
+// Page returns the i-th page of directories, starting from 0, with each page
+// having the given size. The last page may be shorter, and pages after it are
+// empty.
+func (s LocationSnapshot) Page(i, size int) []storedefs.Dir {
+	if i < 0 || size <= 0 || i*size >= len(s.dirs) {
+		return nil
+	}
+	end := (i + 1) * size
+	if end > len(s.dirs) {
+		end = len(s.dirs)
+	}
+	return append([]storedefs.Dir(nil), s.dirs[i*size:end]...)
+}
+
+// Stale returns whether the directories shown by the location mode have
+// changed since the snapshot was taken.
+func (s LocationSnapshot) Stale() bool {
+	return s.current == nil || atomic.LoadInt64(s.current) != s.generation
+}
+
+// Snapshot returns a snapshot of the directories currently shown.
+func (w *location) Snapshot() LocationSnapshot {
+	l, ok := w.ListBox().CopyState().Items.(locationList)
+	if !ok {
+		return LocationSnapshot{}
+	}
+	var dirs []storedefs.Dir
+	for _, e := range l.entries {
+		if e.header == "" {
+			dirs = append(dirs, e.Dir)
+		}
+	}
+	return LocationSnapshot{dirs, l.generation, &w.generation}
+}
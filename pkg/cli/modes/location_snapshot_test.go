@@ -0,0 +1,60 @@
+package modes
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+)
+
+func TestLocation_Snapshot(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var dirs []storedefs.Dir
+	for i := 0; i < 7; i++ {
+		dirs = append(dirs, storedefs.Dir{Path: fixPath(fmt.Sprintf("/d%d", i)), Score: float64(100 - i)})
+	}
+	w, err := NewLocation(f.App, LocationSpec{Store: locationStore{storedDirs: dirs}})
+	startMode(f.App, w, err)
+
+	s := w.Snapshot()
+	if s.Len() != len(dirs) || s.Stale() {
+		t.Fatalf("got snapshot with %d dirs and stale %v, want %d and false",
+			s.Len(), s.Stale(), len(dirs))
+	}
+	// Pages are stable and don't overlap, even after the shown directories
+	// change.
+	var pages [][]storedefs.Dir
+	for i := 0; ; i++ {
+		page := s.Page(i, 3)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		if i == 0 {
+			feedInput(f.TTY, "1")
+			f.TTY.TestBuffer(t, locationRowsBuf("1", 0, matchedRow(" 99 ", fixPath("/d1"), "1")))
+		}
+	}
+	wantPages := [][]storedefs.Dir{dirs[0:3], dirs[3:6], dirs[6:7]}
+	if !reflect.DeepEqual(pages, wantPages) {
+		t.Errorf("got pages %v, want %v", pages, wantPages)
+	}
+	if !s.Stale() {
+		t.Errorf("snapshot not stale after the filter changed")
+	}
+	if s := w.Snapshot(); s.Len() != 1 || s.Stale() {
+		t.Errorf("got new snapshot with %d dirs and stale %v, want 1 and false",
+			s.Len(), s.Stale())
+	}
+}
+
+func TestLocationSnapshot_Zero(t *testing.T) {
+	var s LocationSnapshot
+	if s.Len() != 0 || s.Page(0, 10) != nil || !s.Stale() {
+		t.Errorf("zero LocationSnapshot is not empty and stale")
+	}
+}
@@ -0,0 +1,69 @@
+package modes
+
+import (
+	"sort"
+	"time"
+
+	"src.elv.sh/pkg/store/storedefs"
+)
+
+// LocationVisitTimesStore is an optional interface a LocationStore can
+// implement to provide the times of the first and last visits of directories.
+type LocationVisitTimesStore interface {
+	VisitTimes(dir string) (first, last time.Time, err error)
+}
+
+// LocationStats contains aggregate statistics of the directory history.
+type LocationStats struct {
+	// The number of directories in the history.
+	Dirs int
+	// The total number of visits. Only available if the store implements
+	// LocationRecentVisitsStore.
+	Visits int
+	// The times of the earliest and the latest visits. Only available if the
+	// store implements LocationVisitTimesStore; zero otherwise.
+	Oldest, Newest time.Time
+	// The directories with the highest scores, at most 5 of them, in
+	// descending order of score.
+	Top []storedefs.Dir
+}
+
+// The maximum number of directories in LocationStats.Top.
+const locationStatsTop = 5
+
+// ComputeLocationStats reads the directory history from the store and computes
+// aggregate statistics. Directories for which the number of visits or the
+// visit times can't be determined are left out of the respective statistics.
+func ComputeLocationStats(store LocationStore) (LocationStats, error) {
+	dirs, err := store.Dirs(map[string]struct{}{})
+	if err != nil {
+		return LocationStats{}, err
+	}
+	stats := LocationStats{Dirs: len(dirs)}
+	rs, hasVisits := store.(LocationRecentVisitsStore)
+	ts, hasTimes := store.(LocationVisitTimesStore)
+	for _, dir := range dirs {
+		if hasVisits {
+			if n, err := rs.RecentVisits(dir.Path, time.Time{}); err == nil {
+				stats.Visits += n
+			}
+		}
+		if hasTimes {
+			if first, last, err := ts.VisitTimes(dir.Path); err == nil {
+				if stats.Oldest.IsZero() || first.Before(stats.Oldest) {
+					stats.Oldest = first
+				}
+				if last.After(stats.Newest) {
+					stats.Newest = last
+				}
+			}
+		}
+	}
+	top := append([]storedefs.Dir(nil), dirs...)
+	sort.SliceStable(top, func(i, j int) bool { return top[i].Score > top[j].Score })
+	if len(top) > locationStatsTop {
+		top = top[:locationStatsTop]
+	}
+	stats.Top = top
+	return stats, nil
+}
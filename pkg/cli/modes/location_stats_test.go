@@ -0,0 +1,77 @@
+package modes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"src.elv.sh/pkg/store/storedefs"
+)
+
+// A store that also implements LocationVisitTimesStore, deriving the times
+// from the visits.
+type visitTimesStore struct{ recentVisitsStore }
+
+func (s visitTimesStore) VisitTimes(dir string) (first, last time.Time, err error) {
+	visits, ok := s.visits[dir]
+	if !ok || len(visits) == 0 {
+		return time.Time{}, time.Time{}, errMock
+	}
+	first, last = visits[0], visits[0]
+	for _, visit := range visits {
+		if visit.Before(first) {
+			first = visit
+		}
+		if visit.After(last) {
+			last = visit
+		}
+	}
+	return first, last, nil
+}
+
+func TestComputeLocationStats(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	var dirs []storedefs.Dir
+	for i, path := range []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g"} {
+		dirs = append(dirs, storedefs.Dir{Path: path, Score: float64(i * 10)})
+	}
+	st := visitTimesStore{recentVisitsStore{locationStore{storedDirs: dirs}, map[string][]time.Time{
+		"/a": {t0.Add(3 * day), t0.Add(day)},
+		"/b": {t0.Add(5 * day)},
+		"/c": {t0.Add(2 * day), t0.Add(4 * day), t0.Add(2 * day)},
+	}}}
+
+	stats, err := ComputeLocationStats(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LocationStats{
+		Dirs: 7, Visits: 6, Oldest: t0.Add(day), Newest: t0.Add(5 * day),
+		Top: []storedefs.Dir{
+			{Path: "/g", Score: 60}, {Path: "/f", Score: 50}, {Path: "/e", Score: 40},
+			{Path: "/d", Score: 30}, {Path: "/c", Score: 20}},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestComputeLocationStats_NoVisitInformation(t *testing.T) {
+	dirs := []storedefs.Dir{{Path: "/a", Score: 10}}
+	stats, err := ComputeLocationStats(locationStore{storedDirs: dirs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LocationStats{Dirs: 1, Top: dirs}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestComputeLocationStats_StoreError(t *testing.T) {
+	_, err := ComputeLocationStats(locationStore{dirsError: errMock})
+	if err != errMock {
+		t.Errorf("got error %v, want %v", err, errMock)
+	}
+}
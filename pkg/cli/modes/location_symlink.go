@@ -0,0 +1,18 @@
+package modes
+
+import "path/filepath"
+
+// Returns the target of the directory if it is a symbolic link, with relative
+// targets resolved against the directory containing the link. It returns an
+// empty string if the directory is not a symbolic link, or if that can't be
+// determined within the MaxStats budget. Broken links still have targets.
+func (w *location) symlinkTarget(dir string) string {
+	r, ok := w.stats.Readlink(dir)
+	if !ok || r.err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(r.target) {
+		return filepath.Join(filepath.Dir(dir), r.target)
+	}
+	return filepath.Clean(r.target)
+}
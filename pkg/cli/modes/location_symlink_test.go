@@ -0,0 +1,66 @@
+package modes
+
+import (
+	"errors"
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+var errNotSymlink = errors.New("not a symlink")
+
+func readlinkIn(links map[string]string) func(string) (string, error) {
+	return func(path string) (string, error) {
+		if target, ok := links[path]; ok {
+			return target, nil
+		}
+		return "", errNotSymlink
+	}
+}
+
+var symlinkTestDirs = []storedefs.Dir{
+	{Path: fixPath("/usr"), Score: 200},
+	{Path: fixPath("/opt/link"), Score: 100},
+	{Path: fixPath("/opt/rel"), Score: 50},
+}
+
+var symlinkTestLinks = map[string]string{
+	fixPath("/opt/link"): fixPath("/srv/data"),
+	// Relative targets are resolved against the directory of the link. The
+	// target doesn't exist, but it is still shown.
+	fixPath("/opt/rel"): fixPath("../var/gone"),
+}
+
+func TestLocation_ShowSymlinkTargets(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:              locationStore{storedDirs: symlinkTestDirs},
+		ShowSymlinkTargets: true,
+		Readlink:           readlinkIn(symlinkTestLinks),
+	})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/usr"),
+		"100 "+fixPath("/opt/link")+" -> "+fixPath("/srv/data"),
+		" 50 "+fixPath("/opt/rel")+" -> "+fixPath("/var/gone")))
+}
+
+func TestLocation_MatchSymlinkTargets(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:               locationStore{storedDirs: symlinkTestDirs},
+		MatchSymlinkTargets: true,
+		Readlink:            readlinkIn(symlinkTestLinks),
+	})
+	feedInput(f.TTY, "srv")
+	f.TTY.TestBuffer(t, locationRowsBuf("srv", 0,
+		ui.T("100 "+fixPath("/opt/link"))))
+
+	feedInput(f.TTY, "x")
+	f.TTY.TestBuffer(t, locationRowsBuf("srvx", -1, ui.T("")))
+}
@@ -1,20 +1,27 @@
 package modes
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"src.elv.sh/pkg/cli"
 	. "src.elv.sh/pkg/cli/clitest"
 	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/cli/tk"
 	"src.elv.sh/pkg/store/storedefs"
 	"src.elv.sh/pkg/testutil"
 	"src.elv.sh/pkg/ui"
+	"src.elv.sh/pkg/wcwidth"
 )
 
 type locationStore struct {
@@ -46,6 +53,48 @@ func (ts locationStore) Getwd() (string, error) {
 	return ts.wd, nil
 }
 
+// A LocationStore whose working directory is changed by Chdir.
+type cwdStore struct {
+	locationStore
+	wd *string
+}
+
+func (s cwdStore) Chdir(dir string) error {
+	*s.wd = dir
+	return nil
+}
+
+func (s cwdStore) Getwd() (string, error) { return *s.wd, nil }
+
+// A LocationStore that also implements LocationRecentCommandsStore.
+type commandsStore struct {
+	locationStore
+	commands map[string][]string
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (s *commandsStore) RecentCommands(dir string, n int) ([]string, error) {
+	s.mutex.Lock()
+	s.calls++
+	s.mutex.Unlock()
+	cmds, ok := s.commands[dir]
+	if !ok {
+		return nil, errMock
+	}
+	if len(cmds) > n {
+		cmds = cmds[:n]
+	}
+	return cmds, nil
+}
+
+func (s *commandsStore) getCalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
 func TestNewLocation_NoStore(t *testing.T) {
 	f := Setup()
 	defer f.Stop()
@@ -56,6 +105,33 @@ func TestNewLocation_NoStore(t *testing.T) {
 	}
 }
 
+func TestNewLocationWithStore(t *testing.T) {
+	spec := LocationSpec{
+		Store: locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/opt"), Score: 10}}},
+	}
+	for _, path := range []string{"/usr", "/tmp"} {
+		t.Run(path, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			chdir := ""
+			st := locationStore{
+				storedDirs: []storedefs.Dir{{Path: fixPath(path), Score: 100}},
+				chdir:      func(dir string) error { chdir = dir; return nil },
+			}
+			w, err := NewLocationWithStore(f.App, spec, st)
+			startMode(f.App, w, err)
+			f.TTY.TestBuffer(t, locationBuf("", "100 "+fixPath(path)))
+
+			f.TTY.Inject(term.K(ui.Enter))
+			f.TestTTY(t /* nothing */)
+			if chdir != fixPath(path) {
+				t.Errorf("got chdir %q, want %q", chdir, fixPath(path))
+			}
+		})
+	}
+}
+
 func TestNewLocation_StoreError(t *testing.T) {
 	f := Setup()
 	defer f.Stop()
@@ -95,9 +171,8 @@ func TestLocation_FullWorkflow(t *testing.T) {
 	// Test filtering.
 	f.TTY.Inject(term.K('f'), term.K('o'))
 
-	wantBuf = locationBuf(
-		"fo",
-		" 50 "+fixPath("/tmp/foo/bar/lorem/ipsum"))
+	wantBuf = locationRowsBuf("fo", 0,
+		matchedRow(" 50 ", fixPath("/tmp/foo/bar/lorem/ipsum"), "fo"))
 	f.TTY.TestBuffer(t, wantBuf)
 
 	// Test accepting.
@@ -164,6 +239,252 @@ func TestLocation_Pinned(t *testing.T) {
 	f.TTY.TestBuffer(t, wantBuf)
 }
 
+// A LocationStore that also implements LocationNextLikelyStore.
+type nextLikelyStore struct {
+	locationStore
+	next map[string][]storedefs.Dir
+}
+
+func (s nextLikelyStore) NextLikely(from string, n int) ([]storedefs.Dir, error) {
+	next := s.next[from]
+	if len(next) > n {
+		next = next[:n]
+	}
+	return next, nil
+}
+
+func TestLocation_SuggestNext(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/opt/proj"), Score: 300},
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/opt/proj/test"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: nextLikelyStore{
+			locationStore{storedDirs: dirs, wd: fixPath("/opt/proj")},
+			map[string][]storedefs.Dir{fixPath("/opt/proj"): {
+				{Path: fixPath("/opt/proj/test"), Score: 5},
+				// Not in the history; ignored.
+				{Path: fixPath("/nowhere"), Score: 3},
+				{Path: fixPath("/tmp"), Score: 1},
+			}},
+		},
+		IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+		SuggestNext:   true,
+	})
+	likely := ui.T(" (likely next)", ui.FgBrightBlack)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("  * "+fixPath("/home")),
+		ui.Concat(ui.T("100 "+fixPath("/opt/proj/test")), likely),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp")), likely),
+		ui.T("200 "+fixPath("/usr"))))
+
+	// Suggestions are not surfaced when filtering.
+	feedInput(f.TTY, "t")
+	f.TTY.TestBuffer(t, locationRowsBuf("t", 0,
+		matchedRow("100 ", fixPath("/opt/proj/test"), "t"),
+		matchedRow(" 50 ", fixPath("/tmp"), "t")))
+}
+
+func TestLocation_SuggestNext_Unsupported(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: []storedefs.Dir{
+			{Path: fixPath("/usr"), Score: 200},
+			{Path: fixPath("/tmp"), Score: 50},
+		}},
+		SuggestNext: true,
+	})
+	f.TTY.TestBuffer(t, locationBuf("", "200 "+fixPath("/usr"), " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_MaxPinned(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		IteratePinned: func(f func(string)) {
+			f(fixPath("/home"))
+			f(fixPath("/usr"))
+			f(fixPath("/tmp"))
+		},
+		MaxPinned: 1,
+	})
+	// Pinned directories over the limit are hidden even if they are in the
+	// history.
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("  * "+fixPath("/home")),
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("+2 more pinned", ui.Dim)))
+}
+
+func TestLocation_MarksCurrent(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}},
+			wd:         fixPath("/home")},
+		// The working directory is hidden from the history, but not from
+		// pinned directories.
+		IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("  * "+fixPath("/home")), ui.T(" (current)", ui.FgBrightBlack)),
+		ui.T(" 50 "+fixPath("/tmp"))))
+}
+
+func TestLocation_ScoreFormat(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 12345},
+		{Path: fixPath("/tmp"), Score: 5.25},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: dirs},
+		IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+		ScoreFormat: func(score float64) string {
+			if score >= 1000 {
+				return fmt.Sprintf("%.1fk", score/1000)
+			}
+			return fmt.Sprintf("%.1f", score)
+		},
+	})
+	// The column is as wide as the widest score.
+	f.TTY.TestBuffer(t, locationBuf("",
+		"    * "+fixPath("/home"),
+		"12.3k "+fixPath("/usr/bin"),
+		"  5.2 "+fixPath("/tmp")))
+}
+
+func TestLocation_HeatmapColoring(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 10},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:           locationStore{storedDirs: dirs},
+		IteratePinned:   func(f func(string)) { f(fixPath("/home")) },
+		HeatmapColoring: true,
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("  * "+fixPath("/home")),
+		ui.Concat(ui.T("200 "), ui.T(fixPath("/usr/bin"), ui.FgRed)),
+		ui.Concat(ui.T("100 "), ui.T(fixPath("/usr"), ui.FgGreen)),
+		ui.Concat(ui.T(" 10 "), ui.T(fixPath("/tmp"), ui.FgBlue))))
+
+	// The scale is computed from the matching directories.
+	feedInput(f.TTY, "tmp")
+	tmp := fixPath("/tmp")
+	f.TTY.TestBuffer(t, locationRowsBuf("tmp", 0,
+		ui.Concat(ui.T(" 10 "), ui.T(tmp[:len(tmp)-3], ui.FgRed),
+			ui.T("tmp", ui.FgRed, ui.Underlined))))
+}
+
+func TestLocation_PinPlacement(t *testing.T) {
+	tests := []struct {
+		name         string
+		placement    LocationPinPlacement
+		defaultScore float64
+		lines        []string
+	}{
+		{"top", LocationPinsAtTop, 0, []string{
+			"  * " + fixPath("/home"),
+			"  * " + fixPath("/usr"),
+			"200 " + fixPath("/usr/bin"),
+			" 50 " + fixPath("/tmp")}},
+		{"interleaved", LocationPinsInterleaved, 0, []string{
+			"200 " + fixPath("/usr/bin"),
+			"  * " + fixPath("/usr"),
+			" 50 " + fixPath("/tmp"),
+			"  * " + fixPath("/home")}},
+		{"interleaved with default score", LocationPinsInterleaved, 75, []string{
+			"200 " + fixPath("/usr/bin"),
+			"  * " + fixPath("/usr"),
+			"  * " + fixPath("/home"),
+			" 50 " + fixPath("/tmp")}},
+		{"bottom", LocationPinsAtBottom, 0, []string{
+			"200 " + fixPath("/usr/bin"),
+			" 50 " + fixPath("/tmp"),
+			"  * " + fixPath("/home"),
+			"  * " + fixPath("/usr")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			dirs := []storedefs.Dir{
+				{Path: fixPath("/usr/bin"), Score: 200},
+				{Path: fixPath("/usr"), Score: 100},
+				{Path: fixPath("/tmp"), Score: 50},
+			}
+			startLocation(f.App, LocationSpec{
+				Store: locationStore{storedDirs: dirs},
+				// /home is not in the history.
+				IteratePinned: func(f func(string)) { f(fixPath("/home")); f(fixPath("/usr")) },
+				PinPlacement:  test.placement,
+				DefaultScore:  test.defaultScore,
+			})
+			f.TTY.TestBuffer(t, locationBuf("", test.lines...))
+		})
+	}
+}
+
+func TestLocation_PinnedMarker(t *testing.T) {
+	tests := []struct {
+		name   string
+		marker string
+		lines  []string
+	}{
+		{"narrow marker", "★", []string{
+			"  ★ " + fixPath("/home"),
+			"200 " + fixPath("/usr/bin")}},
+		{"wide marker", "📌", []string{
+			" 📌 " + fixPath("/home"),
+			"200 " + fixPath("/usr/bin")}},
+		{"marker wider than scores", "PIN!", []string{
+			"PIN! " + fixPath("/home"),
+			" 200 " + fixPath("/usr/bin")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store: locationStore{
+					storedDirs: []storedefs.Dir{{Path: fixPath("/usr/bin"), Score: 200}}},
+				IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+				PinnedMarker:  test.marker,
+			})
+			rows := make([]ui.Text, len(test.lines))
+			for i, line := range test.lines {
+				rows[i] = ui.T(line)
+			}
+			f.TTY.TestBuffer(t, locationRowsBuf("", 0, rows...))
+		})
+	}
+}
+
 func TestLocation_HideWd(t *testing.T) {
 	f := Setup()
 	defer f.Stop()
@@ -180,6 +501,414 @@ func TestLocation_HideWd(t *testing.T) {
 	f.TTY.TestBuffer(t, wantBuf)
 }
 
+func TestLocation_ToggleSticky(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: dirs},
+		IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+	})
+	startMode(f.App, w, err)
+	f.TTY.Inject(term.K(ui.Down), term.K(ui.Down), term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 3,
+		ui.T("  * "+fixPath("/home")),
+		ui.T("200 "+fixPath("/usr")),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"))))
+
+	// Sticky directories are below pinned ones but above all other ones.
+	w.ToggleSticky()
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("  * "+fixPath("/home")),
+		ui.Concat(ui.T(" 50 "+fixPath("/opt")), ui.T(" (sticky)", ui.FgGreen)),
+		ui.T("200 "+fixPath("/usr")),
+		ui.T("100 "+fixPath("/tmp"))))
+
+	w.ToggleSticky()
+	f.TTY.TestBuffer(t, locationRowsBuf("", 3,
+		ui.T("  * "+fixPath("/home")),
+		ui.T("200 "+fixPath("/usr")),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"))))
+}
+
+func TestLocation_MinQueryLen(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:       locationStore{storedDirs: dirs},
+		MinQueryLen: 2,
+	})
+
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationBuf("u",
+		"200 "+fixPath("/usr/bin"), " 50 "+fixPath("/tmp")))
+
+	f.TTY.Inject(term.K('s'))
+	f.TTY.TestBuffer(t, locationRowsBuf("us", 0,
+		matchedRow("200 ", fixPath("/usr/bin"), "us")))
+}
+
+func TestLocation_OnResultCount(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	counts := make(chan int, 10)
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: dirs},
+		OnResultCount: func(n int) { counts <- n },
+	})
+
+	f.TTY.Inject(term.K('b'), term.K('i'), term.K('n'), term.K('x'))
+	f.TTY.TestBuffer(t, locationRowsBuf("binx", -1, ui.T("")))
+	close(counts)
+	var got []int
+	for n := range counts {
+		got = append(got, n)
+	}
+	if want := []int{3, 1, 1, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got counts %v, want %v", got, want)
+	}
+}
+
+func TestLocationSpec_Validate(t *testing.T) {
+	ws := func(pattern string) LocationWSIterator {
+		return func(f func(kind, pattern string) bool) { f("ws", pattern) }
+	}
+	tests := []struct {
+		name    string
+		spec    LocationSpec
+		wantErr string
+	}{
+		{"valid", LocationSpec{Store: locationStore{}, IterateWorkspaces: ws("/tmp/[^/]+")}, ""},
+		{"nil store", LocationSpec{}, "no directory history store"},
+		{"bad workspace pattern",
+			LocationSpec{Store: locationStore{}, IterateWorkspaces: ws("/tmp/(")},
+			"workspace ws: error parsing regexp: missing closing ): `^/tmp/(`"},
+		{"too broad workspace pattern",
+			LocationSpec{Store: locationStore{}, IterateWorkspaces: ws(".*")},
+			"workspace ws: pattern matches the root of the filesystem"},
+		{"option requiring another option",
+			LocationSpec{Store: locationStore{}, CacheTTL: time.Minute},
+			"CacheTTL requires Session"},
+		{"option requiring a store interface",
+			LocationSpec{Store: locationStore{}, ShowTTL: true},
+			"ShowTTL requires the store to implement LocationExpiryStore"},
+		{"option with store interface",
+			LocationSpec{Store: expiryStore{}, ShowTTL: true}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.spec.Validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want nil", err)
+				}
+			} else if err == nil || err.Error() != test.wantErr {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+var rememberSelectionsDirs = []storedefs.Dir{
+	{Path: fixPath("/usr/bin"), Score: 200},
+	{Path: fixPath("/usr"), Score: 100},
+	{Path: fixPath("/tmp"), Score: 50},
+}
+
+func TestLocation_RememberSelections(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:              locationStore{storedDirs: rememberSelectionsDirs},
+		RememberSelections: 2,
+	})
+	f.TTY.Inject(term.K(ui.Down), term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 2,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	f.TTY.Inject(term.K('u'), term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 1,
+		matchedRow("200 ", fixPath("/usr/bin"), "u"),
+		matchedRow("100 ", fixPath("/usr"), "u")))
+
+	// The selection for the empty filter is restored.
+	f.TTY.Inject(term.K(ui.Backspace))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 2,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	// And so is the selection for "u".
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 1,
+		matchedRow("200 ", fixPath("/usr/bin"), "u"),
+		matchedRow("100 ", fixPath("/usr"), "u")))
+}
+
+func TestLocation_RememberSelections_Bounded(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:              locationStore{storedDirs: rememberSelectionsDirs},
+		RememberSelections: 1,
+	})
+	f.TTY.Inject(term.K(ui.Down), term.K(ui.Down), term.K('u'), term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 1,
+		matchedRow("200 ", fixPath("/usr/bin"), "u"),
+		matchedRow("100 ", fixPath("/usr"), "u")))
+
+	// Leaving "u" pushes out the selection for the empty filter.
+	f.TTY.Inject(term.K(ui.Backspace))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+}
+
+func TestLocation_Limit(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+		{Path: fixPath("/opt"), Score: 20},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		Limit: 2,
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/usr")),
+		ui.T("+2 more (refine your query)", ui.Dim)))
+
+	// No footer when all matching directories are shown.
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 0,
+		matchedRow("200 ", fixPath("/usr/bin"), "u"),
+		matchedRow("100 ", fixPath("/usr"), "u")))
+}
+
+func TestLocation_ShowPercentile(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 20},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:          locationStore{storedDirs: dirs},
+		IteratePinned:  func(f func(string)) { f(fixPath("/home")) },
+		ShowPercentile: true,
+	})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"   * "+fixPath("/home"),
+		"100% "+fixPath("/usr/bin"),
+		" 75% "+fixPath("/usr"),
+		" 75% "+fixPath("/tmp"),
+		" 25% "+fixPath("/opt")))
+
+	// Percentiles are among the matching directories.
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 0,
+		matchedRow("100% ", fixPath("/usr/bin"), "u"),
+		matchedRow(" 50% ", fixPath("/usr"), "u")))
+}
+
+func TestLocation_CaseInsensitiveFS(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/Users/Me"), Score: 200},
+		{Path: fixPath("/Users/Me/Src"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:             locationStore{storedDirs: dirs, wd: fixPath("/users/me")},
+		IterateHidden:     func(f func(string)) { f(fixPath("/users/me/src")) },
+		CaseInsensitiveFS: true,
+	})
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_CanonicalWd(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("home/src"), Score: 300},
+		{Path: fixPath("/home/elf/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	iterateWorkspaces := func(f func(kind, pattern string) bool) {
+		f("home", regexp.QuoteMeta(fixPath("/home/"))+`[^/\\]+`)
+	}
+	tests := []struct {
+		name string
+		wd   string
+		spec LocationSpec
+	}{
+		{"clean", fixPath("/home/elf/src/../bin/"), LocationSpec{}},
+		{"resolve symlinks", fixPath("/link"), LocationSpec{
+			ResolveWdSymlinks: true,
+			EvalSymlinks: func(path string) (string, error) {
+				if path == fixPath("/link") {
+					return fixPath("/home/elf/bin"), nil
+				}
+				return path, nil
+			},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			spec := test.spec
+			spec.Store = locationStore{storedDirs: dirs, wd: test.wd}
+			spec.IterateWorkspaces = iterateWorkspaces
+			startLocation(f.App, spec)
+			// The working directory is hidden, and the workspace is found.
+			f.TTY.TestBuffer(t, locationBuf("",
+				"300 "+fixPath("home/src"), " 50 "+fixPath("/tmp")))
+		})
+	}
+}
+
+func TestLocation_HideParent(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/home"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	for _, hideParent := range []bool{false, true} {
+		t.Run(fmt.Sprint("HideParent=", hideParent), func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store:      locationStore{storedDirs: dirs, wd: fixPath("/home/elf")},
+				HideParent: hideParent,
+			})
+			if hideParent {
+				f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+			} else {
+				f.TTY.TestBuffer(t, locationBuf("",
+					"200 "+fixPath("/home"), " 50 "+fixPath("/tmp")))
+			}
+		})
+	}
+}
+
+func TestLocation_DuplicatePaths(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/usr"), Score: 300},
+		{Path: fixPath("/tmp"), Score: 50},
+		{Path: fixPath("/home"), Score: 10},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:         locationStore{storedDirs: dirs},
+		IteratePinned: func(f func(string)) { f(fixPath("/home")) },
+	})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"  * "+fixPath("/home"), "300 "+fixPath("/usr"), "100 "+fixPath("/tmp")))
+}
+
+func TestLocation_CollapseSuffixes(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/src/foo.bak"), Score: 200},
+		{Path: fixPath("/src/bar~"), Score: 150},
+		{Path: fixPath("/src/foo"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:            locationStore{storedDirs: dirs},
+		CollapseSuffixes: []string{".bak", "~"},
+	})
+	// foo.bak is merged into foo with the higher score; bar~ is kept since
+	// there is no bar.
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/src/foo"), "150 "+fixPath("/src/bar~"), " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_GitWorktreeOnly(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/src/repo/cmd"), Score: 200},
+		{Path: fixPath("/src/other"), Score: 150},
+		{Path: fixPath("/src/repo"), Score: 100},
+		{Path: fixPath("/src/repository"), Score: 50},
+	}
+	// Only /src/repo has a .git entry.
+	stat := func(path string) (os.FileInfo, error) {
+		if path == fixPath("/src/repo/.git") {
+			return fileInfo{}, nil
+		}
+		return nil, os.ErrNotExist
+	}
+	tests := []struct {
+		name  string
+		wd    string
+		lines []string
+	}{
+		{"in worktree", fixPath("/src/repo/pkg/cli"), []string{
+			"  * " + fixPath("/home"),
+			"200 " + fixPath("/src/repo/cmd"),
+			"100 " + fixPath("/src/repo")}},
+		{"not in worktree", fixPath("/src/other/pkg"), []string{
+			"  * " + fixPath("/home"),
+			"200 " + fixPath("/src/repo/cmd"),
+			"150 " + fixPath("/src/other"),
+			"100 " + fixPath("/src/repo"),
+			" 50 " + fixPath("/src/repository")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store:           locationStore{storedDirs: dirs, wd: test.wd},
+				IteratePinned:   func(f func(string)) { f(fixPath("/home")) },
+				GitWorktreeOnly: true,
+				Stat:            stat,
+			})
+			f.TTY.TestBuffer(t, locationBuf("", test.lines...))
+		})
+	}
+}
+
 func TestLocation_Workspace(t *testing.T) {
 	f := Setup()
 	defer f.Stop()
@@ -202,12 +931,12 @@ func TestLocation_Workspace(t *testing.T) {
 		},
 		IterateWorkspaces: func(f func(kind, pattern string) bool) {
 			if runtime.GOOS == "windows" {
-				// Invalid patterns are ignored.
+				// Invalid patterns are ignored (and reported).
 				f("ws1", `C:\\usr\\[^\\+`)
 				f("home", `C:\\home\\[^\\]+`)
 				f("ws2", `C:\\tmp\[^\]+`)
 			} else {
-				// Invalid patterns are ignored.
+				// Invalid patterns are ignored (and reported).
 				f("ws1", "/usr/[^/+")
 				f("home", "/home/[^/]+")
 				f("ws2", "/tmp/[^/]+")
@@ -229,11 +958,2070 @@ func TestLocation_Workspace(t *testing.T) {
 	}
 }
 
-func locationBuf(filter string, lines ...string) *term.Buffer {
-	b := term.NewBufferBuilder(50).
+func TestLocation_ValidateWorkspaceRoot(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("home/src"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs, wd: fixPath("/home/elf/bin")},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("home", regexp.QuoteMeta(fixPath("/home/"))+`[^/\\]+`)
+		},
+		ValidateWorkspaceRoot: true,
+		Stat: func(dir string) (os.FileInfo, error) {
+			if dir == fixPath("/home/elf") {
+				return nil, os.ErrNotExist
+			}
+			return fileInfo{}, nil
+		},
+	})
+
+	f.TestTTYNotes(t,
+		"error: workspace home: file does not exist", Styles,
+		"!!!!!!")
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_WorkspaceTooBroad(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}},
+			wd:         fixPath("/home/elf"),
+		},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("all", ".*")
+		},
+	})
+
+	f.TestTTYNotes(t,
+		"error: workspace all: pattern matches the root of the filesystem", Styles,
+		"!!!!!!")
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocationWSIterator_ParseChecked(t *testing.T) {
+	ws := LocationWSIterator(func(f func(kind, pattern string) bool) {
+		f("empty", "")
+		f("all", ".*")
+		f("invalid", "[")
+		f("home", regexp.QuoteMeta(fixPath("/home/"))+`\w+`)
+	})
+
+	kind, root, errs := ws.ParseChecked(fixPath("/home/elf/src"))
+	if kind != "home" || root != fixPath("/home/elf") {
+		t.Errorf("got (%q, %q), want (%q, %q)", kind, root, "home", fixPath("/home/elf"))
+	}
+	var kinds []string
+	for _, err := range errs {
+		kinds = append(kinds, strings.Fields(err.Error())[1])
+	}
+	wantKinds := []string{"empty:", "all:", "invalid:"}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("got errors %v, want errors for %v", errs, wantKinds)
+	}
+}
+
+func TestLocation_AcceptInPlace(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	wd := fixPath("/home/elf")
+	dirs := []storedefs.Dir{
+		{Path: fixPath("ws1/src"), Score: 300},
+		{Path: fixPath("/tmp/proj"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: cwdStore{locationStore{storedDirs: dirs}, &wd},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("ws1", regexp.QuoteMeta(fixPath("/tmp/"))+`\w+`)
+		},
+	})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/tmp/proj"), "100 "+fixPath("/usr")))
+
+	// The workspace is detected for the new working directory.
+	w.AcceptInPlace()
+	if wantWd := fixPath("/tmp/proj"); wd != wantWd {
+		t.Errorf("got wd %q, want %q", wd, wantWd)
+	}
+	f.TTY.TestBuffer(t, locationBuf("",
+		"300 "+fixPath("ws1/src"), "100 "+fixPath("/usr")))
+
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTY(t /* nothing */)
+	if wantWd := fixPath("/tmp/proj/src"); wd != wantWd {
+		t.Errorf("got wd %q, want %q", wd, wantWd)
+	}
+}
+
+func TestRecordChdir(t *testing.T) {
+	st := dirRecorder{}
+	ws := LocationWSIterator(func(f func(kind, pattern string) bool) {
+		f("ws", regexp.QuoteMeta(fixPath("/tmp/"))+`\w+`)
+	})
+
+	RecordChdir(st, ws, fixPath("/usr"))
+	RecordChdir(st, ws, fixPath("/tmp/proj/src"))
+	RecordChdir(st, ws, fixPath("/usr"))
+
+	want := dirRecorder{
+		fixPath("/usr"):          2,
+		fixPath("/tmp/proj/src"): 1,
+		fixPath("ws/src"):        1,
+	}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("got scores %v, want %v", st, want)
+	}
+}
+
+func TestRecordChdir_Error(t *testing.T) {
+	err := RecordChdir(failingDirRecorder{}, nil, fixPath("/usr"))
+	if err != errMock {
+		t.Errorf("got error %v, want %v", err, errMock)
+	}
+}
+
+// A LocationDirRecorder that keeps the sum of increment factors of each
+// directory.
+type dirRecorder map[string]float64
+
+func (r dirRecorder) AddDir(dir string, incFactor float64) error {
+	r[dir] += incFactor
+	return nil
+}
+
+type failingDirRecorder struct{}
+
+func (failingDirRecorder) AddDir(string, float64) error { return errMock }
+
+// A LocationStore that also implements LocationDirRecorder.
+type recordingStore struct {
+	locationStore
+	dirRecorder
+}
+
+func TestLocation_RecordsAccepted(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   bool
+		suppress bool
+		want     dirRecorder
+	}{
+		{"default", false, false, dirRecorder{}},
+		{"record", true, false, dirRecorder{fixPath("/usr"): 1}},
+		{"record and suppress", true, true, dirRecorder{}},
+		{"suppress", false, true, dirRecorder{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			st := recordingStore{
+				locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/usr"), Score: 200}}},
+				dirRecorder{}}
+			startLocation(f.App, LocationSpec{Store: st,
+				RecordAccepted: test.record, SuppressAcceptRecording: test.suppress})
+			f.TTY.Inject(term.K(ui.Enter))
+			f.TestTTY(t)
+
+			if !reflect.DeepEqual(st.dirRecorder, test.want) {
+				t.Errorf("got scores %v, want %v", st.dirRecorder, test.want)
+			}
+		})
+	}
+}
+
+// A LocationStore that also implements LocationExpiryStore.
+type expiryStore struct {
+	locationStore
+	expiries map[string]time.Time
+}
+
+func (s expiryStore) Expiry(dir string) (time.Time, error) {
+	return s.expiries[dir], nil
+}
+
+func TestLocation_ShowTTL(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	st := expiryStore{
+		locationStore{storedDirs: []storedefs.Dir{
+			{Path: fixPath("/usr"), Score: 200},
+			{Path: fixPath("/tmp"), Score: 100},
+			{Path: fixPath("/opt"), Score: 50}}},
+		map[string]time.Time{
+			fixPath("/usr"): time.Now().Add(3*time.Hour + 30*time.Minute),
+			fixPath("/opt"): time.Now().Add(-time.Minute)}}
+	startLocation(f.App, LocationSpec{Store: st, ShowTTL: true})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (expires in 3h)", ui.FgBrightBlack)),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.Concat(ui.T(" 50 "+fixPath("/opt")), ui.T(" (expired)", ui.FgBrightBlack))))
+	f.App.PopAddon()
+
+	// Nothing is shown when ShowTTL is not set.
+	startLocation(f.App, LocationSpec{Store: st})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/usr"), "100 "+fixPath("/tmp"), " 50 "+fixPath("/opt")))
+}
+
+// A LocationStore that counts the calls to Dirs.
+type countingStore struct {
+	locationStore
+	calls *int
+}
+
+func (s countingStore) Dirs(blacklist map[string]struct{}) ([]storedefs.Dir, error) {
+	*s.calls++
+	return s.locationStore.Dirs(blacklist)
+}
+
+func TestLocation_CacheTTL(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	calls := 0
+	session := &LocationSession{}
+	open := func(ttl time.Duration) {
+		t.Helper()
+		startLocation(f.App, LocationSpec{
+			Store:    countingStore{locationStore{storedDirs: dirs}, &calls},
+			Session:  session,
+			CacheTTL: ttl,
+		})
+		f.TTY.TestBuffer(t, locationBuf("", "200 "+fixPath("/usr"), " 50 "+fixPath("/tmp")))
+		f.App.PopAddon()
+	}
+	testCalls := func(want int) {
+		t.Helper()
+		if calls != want {
+			t.Errorf("got %d calls to Dirs, want %d", calls, want)
+		}
+	}
+
+	open(time.Hour)
+	open(time.Hour)
+	testCalls(1)
+
+	// Invalidated explicitly.
+	session.Invalidate()
+	open(time.Hour)
+	testCalls(2)
+
+	// Invalidated by changing directory.
+	startLocation(f.App, LocationSpec{
+		Store:    countingStore{locationStore{storedDirs: dirs}, &calls},
+		Session:  session,
+		CacheTTL: time.Hour,
+	})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTY(t)
+	open(time.Hour)
+	testCalls(3)
+
+	// Expired.
+	open(time.Nanosecond)
+	open(time.Nanosecond)
+	testCalls(5)
+}
+
+func TestLocation_JumpBack(t *testing.T) {
+	tmp := testutil.TempDir(t)
+	dirA, dirB := filepath.Join(tmp, "a"), filepath.Join(tmp, "b")
+	testutil.ApplyDirIn(testutil.Dir{"a": testutil.Dir{}, "b": testutil.Dir{}}, tmp)
+
+	f := Setup()
+	defer f.Stop()
+
+	var chdir string
+	session := &LocationSession{}
+	newStore := func(wd string) locationStore {
+		return locationStore{
+			storedDirs: []storedefs.Dir{{Path: dirA, Score: 20}, {Path: dirB, Score: 10}},
+			wd:         wd,
+			chdir:      func(dir string) error { chdir = dir; return nil },
+		}
+	}
+
+	// Accept dirA, then dirB.
+	startLocation(f.App, LocationSpec{Store: newStore(tmp), Session: session})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTY(t /* nothing */)
+	startLocation(f.App, LocationSpec{Store: newStore(dirA), Session: session})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTY(t /* nothing */)
+	if chdir != dirB {
+		t.Fatalf("got chdir %q, want %q", chdir, dirB)
+	}
+
+	// Jumping back from dirB goes to dirA, and jumping back again goes to dirB.
+	for _, test := range []struct{ wd, want string }{{dirB, dirA}, {dirA, dirB}} {
+		w, err := NewLocation(f.App, LocationSpec{Store: newStore(test.wd), Session: session})
+		startMode(f.App, w, err)
+		w.JumpBack()
+		if chdir != test.want {
+			t.Errorf("got chdir %q, want %q", chdir, test.want)
+		}
+		if addons := f.App.CopyState().Addons; len(addons) != 0 {
+			t.Errorf("got %d addons after jumping back, want 0", len(addons))
+		}
+	}
+}
+
+func TestLocation_JumpBack_NonexistentDir(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	chdirCalled := false
+	session := &LocationSession{}
+	session.addAccepted(fixPath("/does/not/exist"))
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{chdir: func(string) error {
+			chdirCalled = true
+			return nil
+		}},
+		Session: session,
+	})
+	startMode(f.App, w, err)
+	w.JumpBack()
+
+	if chdirCalled {
+		t.Errorf("Chdir called for nonexistent directory")
+	}
+	if addons := f.App.CopyState().Addons; len(addons) != 1 {
+		t.Errorf("got %d addons, want 1", len(addons))
+	}
+}
+
+func TestLocation_JumpBack_UsesStat(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	chdirCalled := false
+	session := &LocationSession{}
+	session.addAccepted(fixPath("/usr"))
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{chdir: func(string) error {
+			chdirCalled = true
+			return nil
+		}},
+		Session: session,
+		Stat:    func(string) (os.FileInfo, error) { return nil, errMock },
+	})
+	startMode(f.App, w, err)
+	w.JumpBack()
+
+	if chdirCalled {
+		t.Errorf("Chdir called for directory that can't be stat-ed")
+	}
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+}
+
+func TestLocation_JumpBack_NoLastAccepted(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	w, err := NewLocation(f.App,
+		LocationSpec{Store: locationStore{}, Session: &LocationSession{}})
+	startMode(f.App, w, err)
+	w.JumpBack()
+
+	f.TestTTYNotes(t,
+		"error: no previously accepted directory", Styles,
+		"!!!!!!")
+}
+
+func TestLocation_DebugScores(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/local/bin"), Score: 200},
+		{Path: fixPath("/usr/bin"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	// Shorter paths rank higher.
+	rank := func(filter, path string) float64 {
+		return float64(len(filter)) / float64(len(path))
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs}, Rank: rank, DebugScores: true})
+
+	// Match scores are not shown without a filter.
+	f.TTY.TestBuffer(t, locationBuf(
+		"",
+		"200 "+fixPath("/usr/local/bin"),
+		"100 "+fixPath("/usr/bin"),
+		" 50 "+fixPath("/tmp")))
+
+	f.TTY.Inject(term.K('b'), term.K('i'), term.K('n'))
+	f.TTY.TestBuffer(t, locationRowsBuf("bin", 0,
+		matchedRow(fmt.Sprintf("100 [%.2f] ", rank("bin", fixPath("/usr/bin"))), fixPath("/usr/bin"), "bin"),
+		matchedRow(fmt.Sprintf("200 [%.2f] ", rank("bin", fixPath("/usr/local/bin"))), fixPath("/usr/local/bin"), "bin")))
+}
+
+func TestLocation_Rank_WithoutDebugScores(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/local/bin"), Score: 200},
+		{Path: fixPath("/usr/bin"), Score: 100},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		Rank:  func(_, path string) float64 { return -float64(len(path)) },
+	})
+
+	f.TTY.Inject(term.K('b'))
+	f.TTY.TestBuffer(t, locationRowsBuf("b", 0,
+		matchedRow("100 ", fixPath("/usr/bin"), "b"),
+		matchedRow("200 ", fixPath("/usr/local/bin"), "b")))
+}
+
+func TestStatCache_Budget(t *testing.T) {
+	calls := 0
+	stat := func(string) (os.FileInfo, error) { calls++; return nil, errMock }
+	c := newStatCache(stat, nil, nil, 2)
+
+	for _, path := range []string{"a", "b", "a", "b"} {
+		if r, ok := c.Stat(path); !ok || r.err != errMock {
+			t.Errorf("Stat(%q) -> %v, %v, want cached result", path, r, ok)
+		}
+	}
+	// Budget exhausted.
+	if _, ok := c.Stat("c"); ok {
+		t.Errorf("Stat(%q) succeeded after budget is exhausted", "c")
+	}
+	if calls != 2 {
+		t.Errorf("stat function called %d times, want 2", calls)
+	}
+}
+
+func TestLocation_MaxStats_SharedByFeatures(t *testing.T) {
+	const maxStats = 4
+	f := Setup()
+
+	dirs := make([]storedefs.Dir, 30)
+	for i := range dirs {
+		dirs[i] = storedefs.Dir{Path: fixPath(fmt.Sprintf("/d%02d", i)), Score: float64(100 - i)}
+	}
+	var mutex sync.Mutex
+	var paths []string
+	exhausted := make(chan struct{})
+	count := func(path string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		paths = append(paths, path)
+		if len(paths) == maxStats {
+			close(exhausted)
+		}
+	}
+	startLocation(f.App, LocationSpec{
+		Store:              locationStore{storedDirs: dirs},
+		MaxStats:           maxStats,
+		MarkInaccessible:   true,
+		ShowSymlinkTargets: true,
+		ShowChildCount:     true,
+		Stat: func(path string) (os.FileInfo, error) {
+			count(path)
+			return fileInfo{perm: 0o755}, nil
+		},
+		Readlink: func(path string) (string, error) {
+			count(path)
+			return "", errMock
+		},
+		ReadDir: func(path string) ([]os.DirEntry, error) {
+			count(path)
+			return nil, nil
+		},
+	})
+	select {
+	case <-exhausted:
+	case <-time.After(testutil.Scaled(time.Second)):
+		t.Errorf("budget not exhausted")
+	}
+	f.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(paths) > maxStats {
+		t.Errorf("got %d calls, want at most %d: %v", len(paths), maxStats, paths)
+	}
+	// Each visible row needs a Stat and a Readlink, and the selected row
+	// possibly also a ReadDir, so the budget only covers the first two rows.
+	for _, path := range paths {
+		if path != dirs[0].Path && path != dirs[1].Path {
+			t.Errorf("%s is not among the first rows, but consumed the budget", path)
+		}
+	}
+}
+
+func TestStatCache_Unlimited(t *testing.T) {
+	calls := 0
+	stat := func(string) (os.FileInfo, error) { calls++; return nil, nil }
+	c := newStatCache(stat, nil, nil, 0)
+
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Stat(fmt.Sprint(i)); !ok {
+			t.Errorf("Stat failed with unlimited budget")
+		}
+	}
+	if calls != 10 {
+		t.Errorf("stat function called %d times, want 10", calls)
+	}
+}
+
+func TestLocation_ShowStatus(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:       locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		Rank:        func(string, string) float64 { return 0 },
+		DebugScores: true,
+		ShowStatus:  true,
+	})
+
+	f.TTY.TestBuffer(t, locationStatusBuf("", "[rank] [debug]", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_ShowStatus_NoActiveOptions(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:      locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		ShowStatus: true,
+	})
+
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_ScrollMargin(t *testing.T) {
+	var dirs []storedefs.Dir
+	for i := 0; i < 20; i++ {
+		dirs = append(dirs, storedefs.Dir{Path: fixPath(fmt.Sprintf("/d%02d", i)), Score: float64(100 - i)})
+	}
+	const rows = 8
+	tests := []struct {
+		name       string
+		margin     int
+		hasMargin  bool
+		wantMargin int
+	}{
+		{"default", 0, false, 2},
+		{"zero", 0, true, 0},
+		{"positive", 3, true, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			w, err := NewLocation(f.App, LocationSpec{
+				Store:        locationStore{storedDirs: dirs},
+				ScrollMargin: test.margin, HasScrollMargin: test.hasMargin})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Drive the widget directly, rendering it with one row for the
+			// filter and the rest for the list. When moving down, the list
+			// scrolls just enough to keep the margin below the selected
+			// directory, until the end of the list is reached.
+			for i := 0; i < len(dirs); i++ {
+				if i > 0 {
+					w.Handle(term.K(ui.Down))
+				}
+				w.Render(50, 1+rows)
+				s := w.ListBox().CopyState()
+				if s.Selected != i {
+					t.Fatalf("got selected %d, want %d", s.Selected, i)
+				}
+				wantFirst := i + test.wantMargin - (rows - 1)
+				if wantFirst < 0 {
+					wantFirst = 0
+				} else if wantFirst > len(dirs)-rows {
+					wantFirst = len(dirs) - rows
+				}
+				if s.First != wantFirst {
+					t.Errorf("selected %d: got first %d, want %d", i, s.First, wantFirst)
+				}
+			}
+		})
+	}
+}
+
+func TestLocation_CompactBelowRows(t *testing.T) {
+	spec := LocationSpec{
+		Store:            locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		IteratePinned:    func(f func(string)) { f(fixPath("/home")); f(fixPath("/usr")) },
+		MaxPinned:        1,
+		DebugScores:      true,
+		ShowStatus:       true,
+		CompactBelowRows: 10,
+	}
+
+	// A short terminal uses the compact layout.
+	f := Setup(func(_ *cli.AppSpec, tty TTYCtrl) { tty.SetSize(5, 50) })
+	startLocation(f.App, spec)
+	f.TTY.TestBuffer(t, locationBuf("", "  * "+fixPath("/home"), " 50 "+fixPath("/tmp")))
+	f.Stop()
+
+	// A tall one doesn't.
+	f = Setup()
+	startLocation(f.App, spec)
+	buf := locationStatusBuf("", "[debug]", "  * "+fixPath("/home"), " 50 "+fixPath("/tmp"))
+	buf.Extend(term.NewBufferBuilder(50).Write("+1 more pinned", ui.Dim).Buffer(), false)
+	f.TTY.TestBuffer(t, buf)
+	f.Stop()
+}
+
+type queryStore struct{ query string }
+
+func (s *queryStore) LoadQuery() string      { return s.query }
+func (s *queryStore) SaveQuery(query string) { s.query = query }
+
+func TestLocation_ShowSpinner(t *testing.T) {
+	testutil.Set(t, &spinnerInterval, time.Hour)
+	f := Setup()
+	defer f.Stop()
+
+	release := make(chan struct{})
+	startLocation(f.App, LocationSpec{
+		Store:       locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		ShowSpinner: true,
+		ShowStatus:  true,
+		DebugScores: true,
+		Preview: func(ctx context.Context, dir string) ui.Text {
+			<-release
+			return nil
+		},
+	})
+	f.TTY.TestBuffer(t, locationStatusBuf("", "| [debug]", " 50 "+fixPath("/tmp")))
+
+	close(release)
+	f.TTY.TestBuffer(t, locationStatusBuf("", "[debug]", " 50 "+fixPath("/tmp")))
+}
+
+func TestLocation_QueryStore(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	qs := &queryStore{"tm"}
+	startLocation(f.App, LocationSpec{Store: locationStore{storedDirs: dirs}, QueryStore: qs})
+	// The filter is loaded and applied.
+	f.TTY.TestBuffer(t, locationRowsBuf("tm", 0, matchedRow(" 50 ", fixPath("/tmp"), "tm")))
+
+	// Clearing the filter shows all the directories.
+	f.TTY.Inject(term.K(ui.Backspace), term.K(ui.Backspace))
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/usr/bin"), " 50 "+fixPath("/tmp")))
+
+	f.TTY.Inject(term.K('u'))
+	f.TTY.TestBuffer(t, locationRowsBuf("u", 0, matchedRow("200 ", fixPath("/usr/bin"), "u")))
+	f.App.PopAddon()
+	if qs.query != "u" {
+		t.Errorf("got saved query %q, want %q", qs.query, "u")
+	}
+}
+
+func TestLocation_PushMarked(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var pushed []string
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("ws/src"), Score: 150},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs, wd: fixPath("/home/elf")},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("ws", regexp.QuoteMeta(fixPath("/home/elf")))
+		},
+		PushDirs: func(dirs []string) { pushed = dirs },
+	})
+	startMode(f.App, w, err)
+
+	// Mark /tmp, ws/src and /usr/bin in that order, and unmark /usr/bin.
+	w.ListBox().Select(func(tk.ListBoxState) int { return 2 })
+	w.ToggleMark()
+	w.ListBox().Select(tk.Prev)
+	w.ToggleMark()
+	w.ListBox().Select(tk.Prev)
+	w.ToggleMark()
+	f.TTY.TestBuffer(t, term.NewBufferBuilder(50).
+		Newline().
+		WriteStyled(modeLine(" LOCATION ", true)).SetDotHere().
+		Newline().Write("200 "+fixPath("/usr/bin"), ui.Inverse, ui.Bold).
+		Write(strings.Repeat(" ", 50-len("200 "+fixPath("/usr/bin"))), ui.Inverse).
+		Newline().Write("150 "+fixPath("ws/src"), ui.Bold).
+		Newline().Write(" 50 "+fixPath("/tmp"), ui.Bold).
+		Buffer())
+	w.ToggleMark()
+
+	w.PushMarked()
+	wantPushed := []string{fixPath("/tmp"), fixPath("/home/elf/src")}
+	if !reflect.DeepEqual(pushed, wantPushed) {
+		t.Errorf("got pushed %q, want %q", pushed, wantPushed)
+	}
+	if addons := f.App.CopyState().Addons; len(addons) != 0 {
+		t.Errorf("got %d addons after pushing, want 0", len(addons))
+	}
+}
+
+func TestLocation_ToggleAbsolute(t *testing.T) {
+	home := testutil.InTempHome(t)
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: filepath.Join(home, "go"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs}, ShowStatus: true})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+filepath.Join("~", "go"), " 50 "+fixPath("/tmp")))
+
+	w.ToggleAbsolute()
+	f.TTY.TestBuffer(t, locationStatusBuf("", "[abs]",
+		"200 "+filepath.Join(home, "go"), " 50 "+fixPath("/tmp")))
+
+	// Filtering still works against the abbreviated path.
+	f.TTY.Inject(term.K('~'))
+	f.TTY.TestBuffer(t, locationStatusBuf("~", "[abs]",
+		"200 "+filepath.Join(home, "go")))
+
+	w.ToggleAbsolute()
+	f.TTY.TestBuffer(t, locationRowsBuf("~", 0, matchedRow("200 ", filepath.Join("~", "go"), "~")))
+}
+
+func TestLocation_GroupByWorkspace(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	chdir := ""
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/tmp"), Score: 300},
+		{Path: fixPath("home/src"), Score: 200},
+		{Path: fixPath("/home/elf/bin"), Score: 100},
+		{Path: fixPath("/usr"), Score: 50},
+	}
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: dirs, wd: fixPath("/home/elf"),
+			chdir: func(dir string) error { chdir = dir; return nil }},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("home", regexp.QuoteMeta(fixPath("/home/"))+`[^/\\]+`)
+		},
+		GroupByWorkspace: true,
+	})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationGroupBuf(0,
+		"▾ Other (2)",
+		"300 "+fixPath("/tmp"),
+		" 50 "+fixPath("/usr"),
+		"▾ home (2)",
+		"200 "+fixPath("home/src"),
+		"100 "+fixPath("/home/elf/bin")))
+
+	// Collapse the "Other" group from one of its directories.
+	w.ListBox().Select(tk.Next)
+	w.ToggleGroup()
+	f.TTY.TestBuffer(t, locationGroupBuf(0,
+		"▸ Other (2)",
+		"▾ home (2)",
+		"200 "+fixPath("home/src"),
+		"100 "+fixPath("/home/elf/bin")))
+
+	// Navigation skips the collapsed directories.
+	w.ListBox().Select(tk.Next)
+	w.ListBox().Select(tk.Next)
+	f.App.Redraw()
+	f.TTY.TestBuffer(t, locationGroupBuf(2,
+		"▸ Other (2)",
+		"▾ home (2)",
+		"200 "+fixPath("home/src"),
+		"100 "+fixPath("/home/elf/bin")))
+	w.ListBox().Accept()
+	if want := fixPath("/home/elf/src"); chdir != want {
+		t.Errorf("got chdir %q, want %q", chdir, want)
+	}
+
+	// Accepting a header expands the group.
+	startMode(f.App, w, nil)
+	w.ListBox().Select(func(tk.ListBoxState) int { return 0 })
+	w.ListBox().Accept()
+	f.TTY.TestBuffer(t, locationGroupBuf(0,
+		"▾ Other (2)",
+		"300 "+fixPath("/tmp"),
+		" 50 "+fixPath("/usr"),
+		"▾ home (2)",
+		"200 "+fixPath("home/src"),
+		"100 "+fixPath("/home/elf/bin")))
+}
+
+func TestLocation_GroupByWorkspace_CompilesPatternsOnce(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/tmp"), Score: 300},
+		{Path: fixPath("/home/elf/bin"), Score: 100},
+		{Path: fixPath("/usr"), Score: 50},
+	}
+	iterations := 0
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs, wd: fixPath("/home/elf")},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			iterations++
+			_ = f("bad", "(") && f("home", regexp.QuoteMeta(fixPath("/home/"))+`[^/\\]+`)
+		},
+		GroupByWorkspace: true,
+	})
+	f.TTY.Inject(term.K('u'), term.K(ui.Backspace))
+	f.TTY.TestBuffer(t, locationGroupBuf(0,
+		"▾ Other (2)",
+		"300 "+fixPath("/tmp"),
+		" 50 "+fixPath("/usr"),
+		"▾ home (1)",
+		"100 "+fixPath("/home/elf/bin")))
+	if iterations != 1 {
+		t.Errorf("workspaces iterated %d times, want 1", iterations)
+	}
+	// The invalid pattern is reported when loading.
+	f.TestTTYNotes(t,
+		"error: workspace bad: error parsing regexp: missing closing ): `^(`", Styles,
+		"!!!!!!")
+}
+
+// Like locationBuf, but rows starting with a triangle are rendered as group
+// headers, and the given row is selected.
+func locationGroupBuf(selected int, lines ...string) *term.Buffer {
+	rows := make([]ui.Text, len(lines))
+	for i, line := range lines {
+		var style ui.Styling
+		if strings.HasPrefix(line, "▾") || strings.HasPrefix(line, "▸") {
+			style = ui.FgMagenta
+		}
+		rows[i] = ui.T(line, style)
+	}
+	return locationRowsBuf("", selected, rows...)
+}
+
+type aliasStore struct {
+	locationStore
+	aliases     map[string]string
+	setAliasErr error
+}
+
+func (s aliasStore) Alias(dir string) (string, error) { return s.aliases[dir], nil }
+
+func (s aliasStore) SetAlias(dir, alias string) error {
+	if s.setAliasErr != nil {
+		return s.setAliasErr
+	}
+	s.aliases[dir] = alias
+	return nil
+}
+
+type favoriteStore struct {
+	locationStore
+	favorites      map[string]bool
+	setFavoriteErr error
+}
+
+func (s favoriteStore) IsFavorite(dir string) (bool, error) { return s.favorites[dir], nil }
+
+func (s favoriteStore) SetFavorite(dir string, favorite bool) error {
+	if s.setFavoriteErr != nil {
+		return s.setFavoriteErr
+	}
+	s.favorites[dir] = favorite
+	return nil
+}
+
+func TestLocation_Favorites(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/usr"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	st := favoriteStore{locationStore{storedDirs: dirs},
+		map[string]bool{fixPath("/tmp"): true}, nil}
+	star := ui.T(" ★", ui.FgYellow)
+	w, err := NewLocation(f.App, LocationSpec{Store: st})
+	startMode(f.App, w, err)
+	// Favorites are not moved to the top.
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr/bin")),
+		ui.T("100 "+fixPath("/usr")),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp")), star)))
+
+	w.ToggleFavorite()
+	if !st.favorites[fixPath("/usr/bin")] {
+		t.Errorf("favorite not saved to store")
+	}
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr/bin")), star),
+		ui.T("100 "+fixPath("/usr")),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp")), star)))
+
+	feedInput(f.TTY, "@fav")
+	f.TTY.TestBuffer(t, locationRowsBuf("@fav", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr/bin")), star),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp")), star)))
+
+	// Can be combined with other terms.
+	feedInput(f.TTY, " t")
+	f.TTY.TestBuffer(t, locationRowsBuf("@fav t", 0,
+		ui.Concat(matchedRow(" 50 ", fixPath("/tmp"), "t"), star)))
+
+	w.ToggleFavorite()
+	f.TTY.TestBuffer(t, locationRowsBuf("@fav t", -1, ui.T("")))
+}
+
+func TestLocation_ToggleFavorite_Error(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	st := favoriteStore{locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		map[string]bool{}, errMock}
+	w, err := NewLocation(f.App, LocationSpec{Store: st})
+	startMode(f.App, w, err)
+	w.ToggleFavorite()
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+}
+
+func TestLocation_Alias(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/proj1/src"), Score: 200},
+		{Path: fixPath("/home/elf/proj1"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	st := aliasStore{locationStore{storedDirs: dirs},
+		map[string]string{fixPath("/tmp"): "t", fixPath("/home/elf/proj1"): "proj1"}, nil}
+	w, err := NewLocation(f.App, LocationSpec{Store: st})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		aliasRow("200 "+fixPath("/usr/proj1/src"), ""),
+		aliasRow("100 "+fixPath("/home/elf/proj1"), "proj1"),
+		aliasRow(" 50 "+fixPath("/tmp"), "t")))
+
+	// The filter matches aliases.
+	f.TTY.Inject(term.K('t'))
+	f.TTY.TestBuffer(t, locationRowsBuf("t", 0,
+		ui.Concat(matchedRow(" 50 ", fixPath("/tmp"), "t"), aliasRow("", "t"))))
+
+	// An exact alias match is shown at the top.
+	f.TTY.Inject(term.K(ui.Backspace),
+		term.K('p'), term.K('r'), term.K('o'), term.K('j'), term.K('1'))
+	f.TTY.TestBuffer(t, locationRowsBuf("proj1", 0,
+		ui.Concat(matchedRow("100 ", fixPath("/home/elf/proj1"), "proj1"), aliasRow("", "proj1")),
+		matchedRow("200 ", fixPath("/usr/proj1/src"), "proj1")))
+
+	// Set an alias on the selected directory; the selection stays on it.
+	w.ListBox().Select(tk.Next)
+	w.SetAlias("src")
+	if got := st.aliases[fixPath("/usr/proj1/src")]; got != "src" {
+		t.Errorf("alias in store is %q, want %q", got, "src")
+	}
+	f.TTY.TestBuffer(t, locationRowsBuf("proj1", 1,
+		ui.Concat(matchedRow("100 ", fixPath("/home/elf/proj1"), "proj1"), aliasRow("", "proj1")),
+		ui.Concat(matchedRow("200 ", fixPath("/usr/proj1/src"), "proj1"), aliasRow("", "src"))))
+}
+
+func TestLocation_SetAlias_Error(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	st := aliasStore{
+		locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		map[string]string{}, errMock}
+	w, err := NewLocation(f.App, LocationSpec{Store: st})
+	startMode(f.App, w, err)
+	w.SetAlias("t")
+
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+}
+
+func aliasRow(line, alias string) ui.Text {
+	if alias == "" {
+		return ui.T(line)
+	}
+	return ui.Concat(ui.T(line), ui.T(" @"+alias, ui.FgCyan))
+}
+
+func TestLocation_Preview(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	// The preview of /usr is blocked until it is canceled.
+	canceled := make(chan struct{})
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		Preview: func(ctx context.Context, dir string) ui.Text {
+			if dir == fixPath("/usr") {
+				<-ctx.Done()
+				close(canceled)
+			}
+			return ui.T("preview of " + dir)
+		},
+	})
+
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp")),
+		ui.T("preview of "+fixPath("/tmp"))))
+
+	select {
+	case <-canceled:
+	case <-time.After(testutil.Scaled(time.Second)):
+		t.Fatal("preview of previous selection not canceled")
+	}
+	// The stale preview of /usr is discarded.
+	f.App.Redraw()
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp")),
+		ui.T("preview of "+fixPath("/tmp"))))
+
+	// Changing the filter clears the preview of a selection that is gone.
+	f.TTY.Inject(term.K('x'))
+	f.TTY.TestBuffer(t, locationRowsBuf("x", -1, ui.T("")))
+}
+
+func TestLocation_RecentCommands(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	st := &commandsStore{locationStore: locationStore{storedDirs: dirs},
+		commands: map[string][]string{
+			fixPath("/usr"): {"make install", "make", "git pull"},
+		}}
+	startLocation(f.App, LocationSpec{Store: st, RecentCommands: 2})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp")),
+		ui.Concat(ui.T("$ ", ui.FgGreen), ui.T("make install")),
+		ui.Concat(ui.T("$ ", ui.FgGreen), ui.T("make"))))
+
+	// No preview for directories without recent commands.
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	// Recent commands are cached.
+	f.TTY.Inject(term.K(ui.Up))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T(" 50 "+fixPath("/tmp")),
+		ui.Concat(ui.T("$ ", ui.FgGreen), ui.T("make install")),
+		ui.Concat(ui.T("$ ", ui.FgGreen), ui.T("make"))))
+	if calls := st.getCalls(); calls != 2 {
+		t.Errorf("RecentCommands called %d times, want 2", calls)
+	}
+}
+
+func TestLocation_OnAcceptCommand(t *testing.T) {
+	dirs := []storedefs.Dir{{Path: fixPath("/my dir"), Score: 100}}
+	tests := []struct {
+		name    string
+		quote   func(string) string
+		wantCmd string
+	}{
+		{"no quoting", nil, "cd " + fixPath("/my dir")},
+		{"custom quoting", func(s string) string { return "'" + s + "'" },
+			"cd '" + fixPath("/my dir") + "'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			cmds := make(chan string, 10)
+			startLocation(f.App, LocationSpec{
+				Store:           locationStore{storedDirs: dirs},
+				OnAcceptCommand: func(cmd string) { cmds <- cmd },
+				QuotePath:       test.quote,
+			})
+			f.TTY.Inject(term.K(ui.Enter))
+			f.TestTTY(t /* nothing */)
+			select {
+			case cmd := <-cmds:
+				if cmd != test.wantCmd {
+					t.Errorf("got command %q, want %q", cmd, test.wantCmd)
+				}
+			default:
+				t.Errorf("OnAcceptCommand not called")
+			}
+		})
+	}
+}
+
+func TestLocation_OnAcceptCommand_NotCalledOnError(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	called := make(chan struct{}, 1)
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 100}},
+			chdir:      func(string) error { return errMock }},
+		OnAcceptCommand: func(string) { called <- struct{}{} },
+	})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+	select {
+	case <-called:
+		t.Errorf("OnAcceptCommand called when changing directory failed")
+	default:
+	}
+}
+
+func TestLocation_AcceptFile(t *testing.T) {
+	tests := []struct {
+		name               string
+		acceptFileAsParent bool
+		wantChdir          string
+		wantNote           string
+	}{
+		{"default", false, "", "not a directory: " + fixPath("/opt/file")},
+		{"AcceptFileAsParent", true, fixPath("/opt"), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			chdirCh := make(chan string, 1)
+			startLocation(f.App, LocationSpec{
+				Store: locationStore{
+					storedDirs: []storedefs.Dir{{Path: fixPath("/opt/file"), Score: 100}},
+					chdir:      func(dir string) error { chdirCh <- dir; return nil }},
+				Stat: func(string) (os.FileInfo, error) {
+					return fileInfo{regular: true}, nil
+				},
+				AcceptFileAsParent: test.acceptFileAsParent,
+			})
+			f.TTY.Inject(term.K(ui.Enter))
+			if test.wantNote != "" {
+				f.TestTTYNotes(t,
+					"error: "+test.wantNote, Styles,
+					"!!!!!!")
+			} else {
+				f.TestTTY(t)
+			}
+			select {
+			case dir := <-chdirCh:
+				if dir != test.wantChdir {
+					t.Errorf("got chdir to %q, want %q", dir, test.wantChdir)
+				}
+			default:
+				if test.wantChdir != "" {
+					t.Errorf("Chdir not called, want chdir to %q", test.wantChdir)
+				}
+			}
+		})
+	}
+}
+
+func TestLocation_Pick(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	chdirCalled := false
+	picked := make(chan string, 1)
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: []storedefs.Dir{{Path: fixPath("ws/src"), Score: 50}},
+			wd:         fixPath("/home/elf"),
+			chdir:      func(string) error { chdirCalled = true; return nil },
+		},
+		IterateWorkspaces: func(f func(kind, pattern string) bool) {
+			f("ws", regexp.QuoteMeta(fixPath("/home/elf")))
+		},
+		Pick: func(dir string) { picked <- dir },
+	})
+
+	f.TTY.Inject(term.K(ui.Enter))
+	select {
+	case dir := <-picked:
+		if want := fixPath("/home/elf/src"); dir != want {
+			t.Errorf("got picked %q, want %q", dir, want)
+		}
+	case <-time.After(testutil.Scaled(time.Second)):
+		t.Fatal("Pick not called")
+	}
+	f.TestTTY(t /* nothing */)
+	if chdirCalled {
+		t.Errorf("Chdir called when picking")
+	}
+}
+
+type recentVisitsStore struct {
+	locationStore
+	visits map[string][]time.Time
+}
+
+func (s recentVisitsStore) RecentVisits(dir string, since time.Time) (int, error) {
+	visits, ok := s.visits[dir]
+	if !ok {
+		return 0, errMock
+	}
+	n := 0
+	for _, visit := range visits {
+		if visit.After(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestLocation_RecentWindow(t *testing.T) {
+	now := time.Now()
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+	}
+	st := recentVisitsStore{locationStore{storedDirs: dirs}, map[string][]time.Time{
+		fixPath("/usr"): {now.Add(-30 * 24 * time.Hour)},
+		fixPath("/tmp"): {now.Add(-time.Hour), now.Add(-2 * time.Hour), now.Add(-10 * 24 * time.Hour)},
+		// No data for /opt: the original score is kept.
+	}}
+
+	f := Setup()
+	defer f.Stop()
+	startLocation(f.App, LocationSpec{Store: st, RecentWindow: 7 * 24 * time.Hour})
+	f.TTY.TestBuffer(t, locationBuf("",
+		" 50 "+fixPath("/opt"),
+		"  2 "+fixPath("/tmp"),
+		"  0 "+fixPath("/usr")))
+}
+
+func TestLocation_RecentWindow_Unsupported(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs}, RecentWindow: time.Hour})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/usr"),
+		"100 "+fixPath("/tmp")))
+}
+
+func TestLocation_ShowTodayBadge(t *testing.T) {
+	now := time.Now()
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+	}
+	st := recentVisitsStore{locationStore{storedDirs: dirs}, map[string][]time.Time{
+		fixPath("/usr"): {now, now},
+		fixPath("/tmp"): {now.Add(-48 * time.Hour)},
+	}}
+
+	f := Setup()
+	defer f.Stop()
+	startLocation(f.App, LocationSpec{Store: st, ShowTodayBadge: true})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (2 today)", ui.FgYellow)),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"))))
+}
+
+func TestLocation_ShowChildCount(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/opt"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	fs := map[string][]os.DirEntry{
+		fixPath("/usr"): {dirEntry{"bin", true}, dirEntry{"lib", true}, dirEntry{"README", false}},
+		fixPath("/tmp"): {},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:          locationStore{storedDirs: dirs},
+		ShowChildCount: true,
+		ReadDir: func(dir string) ([]os.DirEntry, error) {
+			if entries, ok := fs[dir]; ok {
+				return entries, nil
+			}
+			return nil, errMock
+		},
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (2 subdirs)", ui.FgBlue)),
+		ui.T("100 "+fixPath("/opt")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	// Unreadable directories show no count.
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (2 subdirs)", ui.FgBlue)),
+		ui.T("100 "+fixPath("/opt")),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 2,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (2 subdirs)", ui.FgBlue)),
+		ui.T("100 "+fixPath("/opt")),
+		ui.Concat(ui.T(" 50 "+fixPath("/tmp")), ui.T(" (0 subdirs)", ui.FgBlue))))
+}
+
+func TestLocation_GitStatus(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/src/clean"), Score: 200},
+		{Path: fixPath("/src/dirty"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	var mutex sync.Mutex
+	calls := map[string]int{}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		GitStatus: func(dir string) (bool, bool) {
+			mutex.Lock()
+			calls[dir]++
+			mutex.Unlock()
+			switch dir {
+			case fixPath("/src/clean"):
+				return true, true
+			case fixPath("/src/dirty"):
+				return false, true
+			}
+			return false, false
+		},
+	})
+	cleanRow := ui.Concat(ui.T("200 "+fixPath("/src/clean")), ui.T(" (git clean)", ui.FgGreen))
+	dirtyRow := ui.Concat(ui.T("100 "+fixPath("/src/dirty")), ui.T(" (git dirty)", ui.FgYellow))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		cleanRow, ui.T("100 "+fixPath("/src/dirty")), ui.T(" 50 "+fixPath("/tmp"))))
+
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		cleanRow, dirtyRow, ui.T(" 50 "+fixPath("/tmp"))))
+
+	// Directories not in a repository have no marker.
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 2,
+		cleanRow, dirtyRow, ui.T(" 50 "+fixPath("/tmp"))))
+
+	// The status is cached.
+	f.TTY.Inject(term.K(ui.Up))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		cleanRow, dirtyRow, ui.T(" 50 "+fixPath("/tmp"))))
+	mutex.Lock()
+	defer mutex.Unlock()
+	if n := calls[fixPath("/src/dirty")]; n != 1 {
+		t.Errorf("got %d calls to GitStatus for %s, want 1", n, fixPath("/src/dirty"))
+	}
+}
+
+func TestLocation_ShowChildCount_RespectsMaxStats(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store:          locationStore{storedDirs: dirs},
+		ShowChildCount: true,
+		MaxStats:       1,
+		ReadDir: func(dir string) ([]os.DirEntry, error) {
+			return []os.DirEntry{dirEntry{"a", true}}, nil
+		},
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (1 subdirs)", ui.FgBlue)),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	// The budget has been exhausted.
+	f.TTY.Inject(term.K(ui.Down))
+	f.TTY.TestBuffer(t, locationRowsBuf("", 1,
+		ui.Concat(ui.T("200 "+fixPath("/usr")), ui.T(" (1 subdirs)", ui.FgBlue)),
+		ui.T(" 50 "+fixPath("/tmp"))))
+}
+
+func TestLocation_Embedded(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	var chdirTo string
+	closed := false
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs,
+			chdir: func(dir string) error { chdirTo = dir; return nil }},
+		Close: func() { closed = true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drive the widget directly, without pushing it as an addon.
+	w.Handle(term.K('t'))
+	l := w.ListBox().CopyState().Items.(locationList)
+	if len(l.entries) != 1 || l.entries[0].Path != fixPath("/tmp") {
+		t.Errorf("got entries %v, want only %q", l.entries, fixPath("/tmp"))
+	}
+	w.Handle(term.K('\n'))
+	if chdirTo != fixPath("/tmp") {
+		t.Errorf("got chdir to %q, want %q", chdirTo, fixPath("/tmp"))
+	}
+	if !closed {
+		t.Errorf("Close not called")
+	}
+	if addons := f.App.CopyState().Addons; len(addons) != 0 {
+		t.Errorf("got addons %v, want none", addons)
+	}
+}
+
+func TestLocation_OnCancelAndOnClose(t *testing.T) {
+	dirs := []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}
+	for _, accept := range []bool{true, false} {
+		f := Setup()
+		calls := make(chan string, 2)
+		startLocation(f.App, LocationSpec{
+			Store:    locationStore{storedDirs: dirs},
+			OnCancel: func() { calls <- "cancel" },
+			OnClose: func(accepted bool) {
+				calls <- fmt.Sprint("close ", accepted)
+				close(calls)
+			},
+		})
+		f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+		if accept {
+			f.TTY.Inject(term.K(ui.Enter))
+			f.TestTTY(t)
+		} else {
+			f.App.PopAddon()
+		}
+
+		var got []string
+		timeout := time.After(testutil.Scaled(time.Second))
+	collect:
+		for {
+			select {
+			case call, ok := <-calls:
+				if !ok {
+					break collect
+				}
+				got = append(got, call)
+			case <-timeout:
+				t.Fatalf("accept = %v: OnClose not called", accept)
+			}
+		}
+		f.Stop()
+
+		want := []string{"cancel", "close false"}
+		if accept {
+			want = []string{"close true"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("accept = %v: got calls %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestLocation_OnCancel_CanNotify(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store:    locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}}},
+		OnCancel: func() { f.App.Notify(ui.T("cancelled")) },
+	})
+	f.TTY.TestBuffer(t, locationBuf("", " 50 "+fixPath("/tmp")))
+	f.App.PopAddon()
+	f.TestTTYNotes(t, "cancelled")
+}
+
+func TestLocation_ProjectRoot(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/src/elvish/pkg"), Score: 200},
+		{Path: fixPath("/src/go/cmd"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	var mutex sync.Mutex
+	calls := map[string]int{}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		ProjectRoot: func(path string) (string, bool) {
+			mutex.Lock()
+			calls[path]++
+			mutex.Unlock()
+			if strings.HasPrefix(path, fixPath("/src/elvish")) {
+				return "elvish", true
+			}
+			if strings.HasPrefix(path, fixPath("/src/go")) {
+				return "golang", true
+			}
+			return "", false
+		},
+		ShowProject: true,
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.Concat(ui.T("200 "+fixPath("/src/elvish/pkg")), ui.T(" [elvish]", ui.FgGreen)),
+		ui.Concat(ui.T("100 "+fixPath("/src/go/cmd")), ui.T(" [golang]", ui.FgGreen)),
+		ui.T(" 50 "+fixPath("/tmp"))))
+
+	// "lang" only matches the name of the project.
+	f.TTY.Inject(term.K('l'), term.K('a'), term.K('n'), term.K('g'))
+	f.TTY.TestBuffer(t, locationRowsBuf("lang", 0,
+		ui.Concat(ui.T("100 "+fixPath("/src/go/cmd")), ui.T(" [golang]", ui.FgGreen))))
+
+	// ProjectRoot is not called again when filtering or redrawing.
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, dir := range dirs {
+		if n := calls[dir.Path]; n != 1 {
+			t.Errorf("ProjectRoot called %d times for %s, want 1", n, dir.Path)
+		}
+	}
+}
+
+func TestLocation_SanitizesPaths(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/nul\x00"), Score: 300},
+		{Path: fixPath("/new\nline"), Score: 200},
+		{Path: fixPath("/bad\xffutf8"), Score: 100},
+	}
+	var chdir string
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs,
+			chdir: func(dir string) error { chdir = dir; return nil }},
+	})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"300 "+fixPath("/nul?"), "200 "+fixPath("/new?line"),
+		"100 "+fixPath("/bad?utf8")))
+
+	f.TTY.Inject(term.K(ui.Down), term.K(ui.Enter))
+	f.TestTTY(t)
+	if want := fixPath("/new\nline"); chdir != want {
+		t.Errorf("got chdir %q, want %q", chdir, want)
+	}
+}
+
+func TestLocation_SanitizesAnnotations(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: aliasStore{
+			locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 100}}},
+			map[string]string{fixPath("/tmp"): "t\x1b[2J"}, nil},
+		ProjectRoot: func(string) (string, bool) { return "p\x07", true },
+		ShowProject: true,
+	})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0, ui.Concat(
+		ui.T("100 "+fixPath("/tmp")), ui.T(" [p?]", ui.FgGreen), ui.T(" @t?[2J", ui.FgCyan))))
+}
+
+func TestLocation_Open(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp/file"), Score: 50},
+	}
+	stat := func(path string) (os.FileInfo, error) {
+		return fileInfo{regular: path == fixPath("/tmp/file")}, nil
+	}
+	for _, tc := range []struct {
+		name       string
+		keys       []term.Event
+		maxStats   int
+		wantChdir  string
+		wantOpened string
+	}{
+		{"directory", []term.Event{term.K(ui.Enter)}, 0, fixPath("/usr"), ""},
+		{"file", []term.Event{term.K(ui.Down), term.K(ui.Enter)}, 0, "", fixPath("/tmp/file")},
+		// Stat is called for the accepted path even when the budget has been
+		// used up by other features.
+		{"file after budget", []term.Event{term.K(ui.Down), term.K(ui.Enter)}, 1, "", fixPath("/tmp/file")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			var chdir, opened string
+			var openedInfo os.FileInfo
+			startLocation(f.App, LocationSpec{
+				Store: locationStore{storedDirs: dirs,
+					chdir: func(dir string) error { chdir = dir; return nil }},
+				Stat:             stat,
+				MaxStats:         tc.maxStats,
+				MarkInaccessible: true,
+				Open: func(path string, info os.FileInfo) error {
+					opened, openedInfo = path, info
+					return nil
+				},
+			})
+			f.TTY.Inject(tc.keys...)
+			f.TestTTY(t)
+
+			if chdir != tc.wantChdir {
+				t.Errorf("got Chdir called with %q, want %q", chdir, tc.wantChdir)
+			}
+			if opened != tc.wantOpened {
+				t.Errorf("got Open called with %q, want %q", opened, tc.wantOpened)
+			}
+			if opened != "" && (openedInfo == nil || openedInfo.IsDir()) {
+				t.Errorf("got Open called with info %v, want info of a file", openedInfo)
+			}
+		})
+	}
+}
+
+func TestLocation_Open_Error(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: []storedefs.Dir{{Path: fixPath("/tmp/file"), Score: 50}}},
+		Stat:  func(string) (os.FileInfo, error) { return fileInfo{regular: true}, nil },
+		Open:  func(string, os.FileInfo) error { return errMock },
+	})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+}
+
+type selectionStore struct {
+	locationStore
+	selections *[]string
+}
+
+func (s selectionStore) RecordSelection(query, path string, rank int) error {
+	*s.selections = append(*s.selections, fmt.Sprintf("%s %s %d", query, path, rank))
+	return errMock
+}
+
+func TestLocation_RecordSelection(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/usr/lib"), Score: 50},
+	}
+	var selections []string
+	startLocation(f.App, LocationSpec{
+		Store: selectionStore{locationStore{storedDirs: dirs}, &selections},
+	})
+	f.TTY.Inject(term.K('u'), term.K(ui.Down), term.K(ui.Enter))
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+	want := []string{"u " + fixPath("/usr/lib") + " 1"}
+	if !reflect.DeepEqual(selections, want) {
+		t.Errorf("got selections %q, want %q", selections, want)
+	}
+}
+
+func TestLocation_QuickFilters(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/src/tests"), Score: 200},
+		{Path: fixPath("/src/docs"), Score: 100},
+		{Path: fixPath("/tmp"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		QuickFilters: []LocationQuickFilter{
+			{Key: ui.K('T', ui.Ctrl), Query: "tests"},
+			{Key: ui.K('D', ui.Ctrl), Query: "docs"},
+		},
+	})
+	f.TTY.Inject(term.K('t'), term.K('m'))
+	f.TTY.TestBuffer(t, locationRowsBuf("tm", 0, matchedRow(" 50 ", fixPath("/tmp"), "tm")))
+
+	// The query replaces the current filter.
+	f.TTY.Inject(term.K('D', ui.Ctrl))
+	f.TTY.TestBuffer(t, locationRowsBuf("docs", 0, matchedRow("100 ", fixPath("/src/docs"), "docs")))
+
+	// Typing continues from the query.
+	f.TTY.Inject(term.K('T', ui.Ctrl), term.K('x'))
+	f.TTY.TestBuffer(t, locationRowsBuf("testsx", -1, ui.T("")))
+}
+
+func TestLocation_PostAccept(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	var chdir string
+	var calls []string
+	hook := func(name string, err error) func(string) error {
+		return func(dir string) error {
+			calls = append(calls, name+" "+dir)
+			return err
+		}
+	}
+	startLocation(f.App, LocationSpec{
+		Store: locationStore{
+			storedDirs: []storedefs.Dir{{Path: fixPath("/tmp"), Score: 50}},
+			chdir:      func(dir string) error { chdir = dir; return nil }},
+		PostAccept: []func(string) error{
+			hook("a", nil), hook("b", errMock), hook("c", nil)},
+	})
+	f.TTY.Inject(term.K(ui.Enter))
+	f.TestTTYNotes(t,
+		"error: mock error", Styles,
+		"!!!!!!")
+	if chdir != fixPath("/tmp") {
+		t.Errorf("got chdir %q, want %q", chdir, fixPath("/tmp"))
+	}
+	want := []string{"a " + fixPath("/tmp"), "b " + fixPath("/tmp")}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %q, want %q", calls, want)
+	}
+}
+
+type sortKeyStore struct {
+	locationStore
+	keys map[string]float64
+}
+
+func (s sortKeyStore) SortKey(dir storedefs.Dir) float64 { return s.keys[dir.Path] }
+
+func TestLocation_SortKey(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/home"), Score: 50},
+	}
+	startLocation(f.App, LocationSpec{
+		Store: sortKeyStore{locationStore{storedDirs: dirs}, map[string]float64{
+			fixPath("/usr/bin"): 1, fixPath("/tmp"): 3, fixPath("/home"): 2}},
+		IteratePinned: func(f func(string)) { f(fixPath("/usr")) },
+	})
+	f.TTY.TestBuffer(t, locationBuf("",
+		"  * "+fixPath("/usr"),
+		"100 "+fixPath("/tmp"),
+		" 50 "+fixPath("/home"),
+		"200 "+fixPath("/usr/bin")))
+}
+
+func TestLocation_PrefetchTopN(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+	}
+	statted := make(chan string, len(dirs))
+	w, err := NewLocation(f.App, LocationSpec{
+		Store:        locationStore{storedDirs: dirs},
+		PrefetchTopN: 2,
+		Stat: func(dir string) (os.FileInfo, error) {
+			statted <- dir
+			return fileInfo{}, nil
+		},
+	})
+	startMode(f.App, w, err)
+	f.TTY.TestBuffer(t, locationBuf("",
+		"200 "+fixPath("/usr"), "100 "+fixPath("/tmp"), " 50 "+fixPath("/opt")))
+
+	for _, want := range []string{fixPath("/usr"), fixPath("/tmp")} {
+		select {
+		case dir := <-statted:
+			if dir != want {
+				t.Errorf("got %q prefetched, want %q", dir, want)
+			}
+		case <-time.After(testutil.Scaled(time.Second)):
+			t.Fatalf("timed out waiting for %q to be prefetched", want)
+		}
+	}
+	for _, dir := range []string{fixPath("/usr"), fixPath("/tmp")} {
+		if _, ok := w.(*location).stats.Stat(dir); !ok {
+			t.Errorf("%q not cached", dir)
+		}
+	}
+	select {
+	case dir := <-statted:
+		t.Errorf("got %q statted, want only the top 2 prefetched", dir)
+	case <-time.After(testutil.Scaled(10 * time.Millisecond)):
+	}
+}
+
+func TestLocation_PrefetchTopN_CanceledOnClose(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+	}
+	statted := make(chan string, len(dirs))
+	unblock := make(chan struct{})
+	startLocation(f.App, LocationSpec{
+		Store:        locationStore{storedDirs: dirs},
+		PrefetchTopN: 2,
+		Stat: func(dir string) (os.FileInfo, error) {
+			statted <- dir
+			<-unblock
+			return fileInfo{}, nil
+		},
+	})
+	<-statted
+	f.App.PopAddon()
+	close(unblock)
+	select {
+	case dir := <-statted:
+		t.Errorf("got %q statted after closing", dir)
+	case <-time.After(testutil.Scaled(10 * time.Millisecond)):
+	}
+}
+
+func TestLocation_DimOlderThan(t *testing.T) {
+	now := time.Now()
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+		{Path: fixPath("/srv"), Score: 20},
+	}
+	// The visits of /srv can't be determined.
+	st := recentVisitsStore{locationStore{storedDirs: dirs}, map[string][]time.Time{
+		fixPath("/usr"): {now.Add(-time.Hour)},
+		fixPath("/tmp"): {now.Add(-48 * time.Hour), now.Add(-2 * time.Hour)},
+		fixPath("/opt"): {now.Add(-48 * time.Hour)},
+	}}
+
+	f := Setup()
+	defer f.Stop()
+	startLocation(f.App, LocationSpec{Store: st, DimOlderThan: 24 * time.Hour})
+	f.TTY.TestBuffer(t, locationRowsBuf("", 0,
+		ui.T("200 "+fixPath("/usr")),
+		ui.T("100 "+fixPath("/tmp")),
+		ui.T(" 50 "+fixPath("/opt"), ui.Dim),
+		ui.T(" 20 "+fixPath("/srv"))))
+}
+
+func TestLocation_EmptyQueryOrder(t *testing.T) {
+	now := time.Now()
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/usr"), Score: 50},
+		{Path: fixPath("/opt"), Score: 20},
+	}
+	st := visitTimesStore{recentVisitsStore{locationStore{storedDirs: dirs}, map[string][]time.Time{
+		fixPath("/usr/bin"): {now.Add(-3 * time.Hour)},
+		fixPath("/tmp"):     {now.Add(-2 * time.Hour)},
+		fixPath("/usr"):     {now.Add(-time.Hour)},
+	}}}
+	tests := []struct {
+		name  string
+		order LocationOrder
+		lines []string
+	}{
+		{"score", LocationOrderByScore, []string{
+			"  * " + fixPath("/home"),
+			"200 " + fixPath("/usr/bin"),
+			"100 " + fixPath("/tmp"),
+			" 50 " + fixPath("/usr"),
+			" 20 " + fixPath("/opt")}},
+		{"recency", LocationOrderByRecency, []string{
+			"  * " + fixPath("/home"),
+			" 50 " + fixPath("/usr"),
+			"100 " + fixPath("/tmp"),
+			"200 " + fixPath("/usr/bin"),
+			" 20 " + fixPath("/opt")}},
+		{"alphabetical", LocationOrderAlphabetically, []string{
+			"  * " + fixPath("/home"),
+			" 20 " + fixPath("/opt"),
+			"100 " + fixPath("/tmp"),
+			" 50 " + fixPath("/usr"),
+			"200 " + fixPath("/usr/bin")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store:           st,
+				IteratePinned:   func(f func(string)) { f(fixPath("/home")) },
+				EmptyQueryOrder: test.order,
+			})
+			f.TTY.TestBuffer(t, locationBuf("", test.lines...))
+
+			// Filtered directories are in the usual order.
+			f.TTY.Inject(term.K('u'))
+			f.TTY.TestBuffer(t, locationRowsBuf("u", 0,
+				matchedRow("200 ", fixPath("/usr/bin"), "u"), matchedRow(" 50 ", fixPath("/usr"), "u")))
+		})
+	}
+}
+
+func TestLocation_Less(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr/local/bin"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/usr/bin"), Score: 50},
+	}
+	// Shorter paths first.
+	less := func(a, b storedefs.Dir) bool { return len(a.Path) < len(b.Path) }
+	tests := []struct {
+		name           string
+		includesPinned bool
+		lines          []string
+	}{
+		{"pinned first", false, []string{
+			"  * " + fixPath("/pinned/dir"),
+			"100 " + fixPath("/tmp"),
+			" 50 " + fixPath("/usr/bin"),
+			"200 " + fixPath("/usr/local/bin")}},
+		{"pinned included", true, []string{
+			"100 " + fixPath("/tmp"),
+			" 50 " + fixPath("/usr/bin"),
+			"  * " + fixPath("/pinned/dir"),
+			"200 " + fixPath("/usr/local/bin")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store:              locationStore{storedDirs: dirs},
+				IteratePinned:      func(f func(string)) { f(fixPath("/pinned/dir")) },
+				Less:               less,
+				LessIncludesPinned: test.includesPinned,
+			})
+			f.TTY.TestBuffer(t, locationBuf("", test.lines...))
+		})
+	}
+}
+
+func TestLocation_SelectPath(t *testing.T) {
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/usr"), Score: 200},
+		{Path: fixPath("/tmp"), Score: 100},
+		{Path: fixPath("/opt"), Score: 50},
+	}
+	rows := []ui.Text{
+		ui.T("200 " + fixPath("/usr")),
+		ui.T("100 " + fixPath("/tmp")),
+		ui.T(" 50 " + fixPath("/opt")),
+	}
+	tests := []struct {
+		path     string
+		selected int
+	}{
+		{fixPath("/opt"), 2},
+		{fixPath("/nonexistent"), 0},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			f := Setup()
+			defer f.Stop()
+
+			startLocation(f.App, LocationSpec{
+				Store: locationStore{storedDirs: dirs}, SelectPath: test.path})
+			f.TTY.TestBuffer(t, locationRowsBuf("", test.selected, rows...))
+		})
+	}
+}
+
+// Returns a row with prefix followed by path, with the first occurrence of
+// match in path underlined as the default matcher highlights it.
+func matchedRow(prefix, path, match string) ui.Text {
+	i := strings.Index(path, match)
+	return ui.Concat(ui.T(prefix+path[:i]), ui.T(match, ui.Underlined), ui.T(path[i+len(match):]))
+}
+
+func locationBuf(filter string, lines ...string) *term.Buffer {
+	return locationStatusBuf(filter, "", lines...)
+}
+
+// Like locationBuf, but with a status shown on the right of the filter.
+func locationStatusBuf(filter, status string, lines ...string) *term.Buffer {
+	b := term.NewBufferBuilder(50).
 		Newline(). // empty code area
 		WriteStyled(modeLine(" LOCATION ", true)).
 		Write(filter).SetDotHere()
+	if status != "" {
+		b.Write(strings.Repeat(" ", 50-len(" LOCATION  ")-len(filter)-len(status)) + status)
+	}
 	for i, line := range lines {
 		b.Newline()
 		if i == 0 {
@@ -245,6 +3033,53 @@ func locationBuf(filter string, lines ...string) *term.Buffer {
 	return b.Buffer()
 }
 
+// Like locationBuf, but takes styled rows and the index of the selected row.
+func locationRowsBuf(filter string, selected int, rows ...ui.Text) *term.Buffer {
+	return locationRowsBuilder(filter, selected, rows...).Buffer()
+}
+
+func locationRowsBuilder(filter string, selected int, rows ...ui.Text) *term.BufferBuilder {
+	return locationPromptRowsBuilder(modeLine(" LOCATION ", true), filter, selected, rows...)
+}
+
+func locationPromptRowsBuilder(prompt ui.Text, filter string, selected int, rows ...ui.Text) *term.BufferBuilder {
+	b := term.NewBufferBuilder(50).
+		Newline(). // empty code area
+		WriteStyled(prompt).
+		Write(filter).SetDotHere()
+	for i, row := range rows {
+		b.Newline()
+		if i == selected {
+			width := 0
+			for _, seg := range row {
+				width += wcwidth.Of(seg.Text)
+			}
+			row = ui.StyleText(
+				ui.Concat(row, ui.T(strings.Repeat(" ", 50-width))), ui.Inverse)
+		}
+		b.WriteStyled(row)
+	}
+	return b
+}
+
+// A fake os.DirEntry.
+type dirEntry struct {
+	name string
+	dir  bool
+}
+
+func (e dirEntry) Name() string { return e.name }
+func (e dirEntry) IsDir() bool  { return e.dir }
+
+func (e dirEntry) Type() os.FileMode {
+	if e.dir {
+		return os.ModeDir
+	}
+	return 0
+}
+
+func (e dirEntry) Info() (os.FileInfo, error) { return nil, errMock }
+
 func fixPath(path string) string {
 	if runtime.GOOS != "windows" {
 		return path
@@ -255,7 +3090,40 @@ func fixPath(path string) string {
 	return strings.ReplaceAll(path, "/", "\\")
 }
 
+func feedInput(ttyCtrl TTYCtrl, input string) {
+	for _, r := range input {
+		ttyCtrl.Inject(term.K(r))
+	}
+}
+
 func startLocation(app cli.App, spec LocationSpec) {
 	w, err := NewLocation(app, spec)
 	startMode(app, w, err)
 }
+
+func BenchmarkLocation_LargeBlacklist(b *testing.B) {
+	const nStored, nHidden = 100000, 10000
+	dirs := make([]storedefs.Dir, nStored)
+	for i := range dirs {
+		dirs[i] = storedefs.Dir{Path: fmt.Sprintf("/dir/%d", i), Score: float64(nStored - i)}
+	}
+	spec := LocationSpec{
+		Store: locationStore{storedDirs: dirs},
+		IterateHidden: func(f func(string)) {
+			// Hide every tenth directory.
+			for i := 0; i < nHidden; i++ {
+				f(fmt.Sprintf("/dir/%d", i*nStored/nHidden))
+			}
+		},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := NewLocation(nil, spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n := len(w.(*location).dirs); n != nStored-nHidden {
+			b.Fatalf("got %d directories, want %d", n, nStored-nHidden)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package modes
+
+import (
+	"path/filepath"
+
+	"src.elv.sh/pkg/cli/tk"
+	"src.elv.sh/pkg/fsutil"
+	"src.elv.sh/pkg/ui"
+)
+
+// ZoomIn narrows the list to the directories under the selected directory,
+// which are then shown relative to it. The filter is cleared.
+func (w *location) ZoomIn() {
+	dir, ok := w.selected()
+	if !ok {
+		return
+	}
+	root := w.resolve(dir.Path)
+	w.mutateState(func(s *locationState) {
+		zoom := make([]string, len(s.zoom), len(s.zoom)+1)
+		copy(zoom, s.zoom)
+		s.zoom = append(zoom, root)
+	})
+	w.CodeArea().MutateState(func(s *tk.CodeAreaState) { s.Buffer = tk.CodeBuffer{} })
+	w.ListBox().Reset(w.filter(""), 0)
+	w.app.Redraw()
+}
+
+// ZoomOut undoes the last ZoomIn, selecting the directory that was zoomed into.
+func (w *location) ZoomOut() {
+	zoom := w.copyState().zoom
+	if len(zoom) == 0 {
+		return
+	}
+	root := zoom[len(zoom)-1]
+	w.mutateState(func(s *locationState) { s.zoom = zoom[:len(zoom)-1] })
+	l := w.filter(w.CodeArea().CopyState().Buffer.Content)
+	selected := l.findPath(root)
+	if selected == -1 {
+		selected = 0
+	}
+	w.ListBox().Reset(l, selected)
+	w.app.Redraw()
+}
+
+// Returns the directory the list is zoomed into, or "" if it is not zoomed.
+func (w *location) zoomRoot() string {
+	if zoom := w.copyState().zoom; len(zoom) > 0 {
+		return zoom[len(zoom)-1]
+	}
+	return ""
+}
+
+// Returns the path of dir relative to root, and whether dir is under root.
+func relativeTo(dir, root string) (string, bool) {
+	if dir == root || !hasPathPrefix(dir, root) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, dir)
+	return rel, err == nil
+}
+
+func (w *location) prompt() ui.Text {
+	p := modeLine(w.promptLabel(), true)
+	zoom := w.copyState().zoom
+	for i, root := range zoom {
+		crumb := fsutil.TildeAbbr(root)
+		if i > 0 {
+			crumb, _ = relativeTo(root, zoom[i-1])
+		}
+		p = ui.Concat(p, ui.T(crumb, ui.FgBlue), ui.T(" > "))
+	}
+	return p
+}
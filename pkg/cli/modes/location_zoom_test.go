@@ -0,0 +1,76 @@
+package modes
+
+import (
+	"testing"
+
+	. "src.elv.sh/pkg/cli/clitest"
+	"src.elv.sh/pkg/cli/term"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/ui"
+)
+
+func TestLocation_Zoom(t *testing.T) {
+	f := Setup()
+	defer f.Stop()
+
+	dirs := []storedefs.Dir{
+		{Path: fixPath("/opt/src"), Score: 200},
+		{Path: fixPath("/opt/src/elvish"), Score: 100},
+		{Path: fixPath("/opt/src/elvish/pkg"), Score: 50},
+		{Path: fixPath("/usr"), Score: 20},
+	}
+	var chdirTo string
+	w, err := NewLocation(f.App, LocationSpec{
+		Store: locationStore{storedDirs: dirs,
+			chdir: func(dir string) error { chdirTo = dir; return nil }},
+	})
+	startMode(f.App, w, err)
+	fullBuf := func(selected int) *term.Buffer {
+		return locationRowsBuf("", selected,
+			ui.T("200 "+fixPath("/opt/src")),
+			ui.T("100 "+fixPath("/opt/src/elvish")),
+			ui.T(" 50 "+fixPath("/opt/src/elvish/pkg")),
+			ui.T(" 20 "+fixPath("/usr")))
+	}
+	f.TTY.TestBuffer(t, fullBuf(0))
+
+	// Zoom into /opt/src.
+	w.ZoomIn()
+	crumbs := ui.Concat(modeLine(" LOCATION ", true),
+		ui.T(fixPath("/opt/src"), ui.FgBlue), ui.T(" > "))
+	f.TTY.TestBuffer(t, locationPromptRowsBuilder(crumbs, "", 0,
+		ui.T("100 elvish"),
+		ui.T(" 50 "+fixPath("elvish/pkg"))).Buffer())
+
+	// Filtering is relative to the zoom root.
+	feedInput(f.TTY, "pkg")
+	f.TTY.TestBuffer(t, locationPromptRowsBuilder(crumbs, "pkg", 0,
+		matchedRow(" 50 ", fixPath("elvish/pkg"), "pkg")).Buffer())
+	f.TTY.Inject(term.K(ui.Backspace), term.K(ui.Backspace), term.K(ui.Backspace))
+	f.TTY.TestBuffer(t, locationPromptRowsBuilder(crumbs, "", 0,
+		ui.T("100 elvish"),
+		ui.T(" 50 "+fixPath("elvish/pkg"))).Buffer())
+
+	// Nested zooming.
+	w.ZoomIn()
+	nestedCrumbs := ui.Concat(crumbs, ui.T("elvish", ui.FgBlue), ui.T(" > "))
+	f.TTY.TestBuffer(t, locationPromptRowsBuilder(nestedCrumbs, "", 0,
+		ui.T(" 50 pkg")).Buffer())
+
+	// Zooming out selects the directory that was zoomed into.
+	w.ZoomOut()
+	f.TTY.TestBuffer(t, locationPromptRowsBuilder(crumbs, "", 0,
+		ui.T("100 elvish"),
+		ui.T(" 50 "+fixPath("elvish/pkg"))).Buffer())
+	w.ZoomOut()
+	f.TTY.TestBuffer(t, fullBuf(0))
+	w.ZoomOut() // No-op
+
+	// Accepting uses the full path.
+	w.ZoomIn()
+	f.TTY.Inject(term.K(ui.Down), term.K(ui.Enter))
+	f.TTY.TestBuffer(t, term.NewBufferBuilder(50).SetDotHere().Buffer())
+	if want := fixPath("/opt/src/elvish/pkg"); chdirTo != want {
+		t.Errorf("got chdir to %q, want %q", chdirTo, want)
+	}
+}
@@ -41,7 +41,9 @@ func NewComboBox(spec ComboBoxSpec) ComboBox {
 		listBox:  NewListBox(spec.ListBox),
 		OnFilter: spec.OnFilter,
 	}
-	w.OnFilter(w, "")
+	filter := w.codeArea.CopyState().Buffer.Content
+	w.OnFilter(w, filter)
+	w.lastFilter = filter
 	return w
 }
 
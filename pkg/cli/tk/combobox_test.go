@@ -108,3 +108,18 @@ func TestRefilter(t *testing.T) {
 		t.Errorf("OnFilter not called by Refilter")
 	}
 }
+
+func TestComboBox_InitialFilter(t *testing.T) {
+	var filters []string
+	w := NewComboBox(ComboBoxSpec{
+		CodeArea: CodeAreaSpec{
+			State: CodeAreaState{Buffer: CodeBuffer{Content: "a", Dot: 1}}},
+		OnFilter: func(w ComboBox, filter string) {
+			filters = append(filters, filter)
+		}})
+	// Clearing the initial filter should trigger OnFilter.
+	w.Handle(term.K(ui.Backspace))
+	if len(filters) != 2 || filters[0] != "a" || filters[1] != "" {
+		t.Errorf("OnFilter called with %q, want [a \"\"]", filters)
+	}
+}
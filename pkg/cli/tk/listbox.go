@@ -45,6 +45,12 @@ type ListBoxSpec struct {
 	// first segment of the item, and the right spacing and padding will be
 	// styled the same as the last segment of the item.
 	ExtendStyle bool
+	// The number of lines to keep between the selected item and the top and
+	// bottom edges of the window in the vertical layout, when possible. It is
+	// only used if HasScrollMargin is true; otherwise 2 lines are kept.
+	ScrollMargin int
+	// Whether ScrollMargin is set.
+	HasScrollMargin bool
 
 	// State. When used in New, this field specifies the initial state.
 	State ListBoxState
@@ -179,7 +185,14 @@ func (w *listBox) renderVertical(width, height int) *term.Buffer {
 		if s.Items == nil || s.Items.Len() == 0 {
 			s.First = 0
 		} else {
-			s.First, firstCrop = getVerticalWindow(*s, height)
+			distance := respectDistance
+			if w.HasScrollMargin {
+				distance = w.ScrollMargin
+				if distance < 0 {
+					distance = 0
+				}
+			}
+			s.First, firstCrop = getVerticalWindow(*s, height, distance)
 		}
 		s.Height = height
 		state = *s
@@ -2,9 +2,10 @@ package tk
 
 import "src.elv.sh/pkg/wcwidth"
 
-// The number of lines the listing mode keeps between the current selected item
-// and the top and bottom edges of the window, unless the available height is
-// too small or if the selected item is near the top or bottom of the list.
+// The default number of lines the listing mode keeps between the current
+// selected item and the top and bottom edges of the window, unless the
+// available height is too small or if the selected item is near the top or
+// bottom of the list. It can be changed with ListBoxSpec.ScrollMargin.
 var respectDistance = 2
 
 // Determines the index of the first item to show in vertical mode.
@@ -18,13 +19,13 @@ var respectDistance = 2
 //   - The combined height of all the entries in the window is equal to
 //     min(height, combined height of all entries).
 //
-//   - There are at least respectDistance rows above the first row of the selected
+//   - There are at least distance rows above the first row of the selected
 //     item, as well as that many rows below the last row of the selected item,
 //     unless the height is too small.
 //
 //   - Among all values satisfying the above conditions, the value of first is
 //     the one closest to lastFirst.
-func getVerticalWindow(state ListBoxState, height int) (first, crop int) {
+func getVerticalWindow(state ListBoxState, height, distance int) (first, crop int) {
 	items, selected, lastFirst := state.Items, state.Selected, state.First
 	n := items.Len()
 	if selected < 0 {
@@ -43,10 +44,10 @@ func getVerticalWindow(state ListBoxState, height int) (first, crop int) {
 	// Determine the minimum amount of space required for the downward direction.
 	budget := height - selectedHeight
 	var needDown int
-	if budget >= 2*respectDistance {
+	if budget >= 2*distance {
 		// If we can afford maintaining the respect distance on both sides, then
 		// the minimum amount of space required is the respect distance.
-		needDown = respectDistance
+		needDown = distance
 	} else {
 		// Otherwise we split the available space by half. The downward (no pun
 		// intended) rounding here is an arbitrary choice.
@@ -88,7 +89,7 @@ func getVerticalWindow(state ListBoxState, height int) (first, crop int) {
 		if useUp >= budgetUp {
 			return i, useUp - budgetUp
 		}
-		if i <= lastFirst && useUp >= respectDistance && useUp+useDown >= budget {
+		if i <= lastFirst && useUp >= distance && useUp+useDown >= budget {
 			return i, 0
 		}
 	}
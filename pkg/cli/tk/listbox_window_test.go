@@ -10,31 +10,40 @@ func TestGetVerticalWindow(t *testing.T) {
 	tt.Test(t, tt.Fn("getVerticalWindow", getVerticalWindow), tt.Table{
 		// selected = 0: always show a widow starting from 0, regardless of
 		// the value of oldFirst
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 0, First: 0}, 6).Rets(0, 0),
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 0, First: 1}, 6).Rets(0, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 0, First: 0}, 6, 2).Rets(0, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 0, First: 1}, 6, 2).Rets(0, 0),
 		// selected < 0 is treated as if = 0.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: -1, First: 0}, 6).Rets(0, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: -1, First: 0}, 6, 2).Rets(0, 0),
 		// selected = n-1: always show a window ending at n-1, regardless of the
 		// value of oldFirst
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 9, First: 0}, 6).Rets(4, 0),
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 9, First: 8}, 6).Rets(4, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 9, First: 0}, 6, 2).Rets(4, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 9, First: 8}, 6, 2).Rets(4, 0),
 		// selected >= n is treated as if = n-1.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 10, First: 0}, 6).Rets(4, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 10, First: 0}, 6, 2).Rets(4, 0),
 		// selected = 3, oldFirst = 2 (likely because previous selected = 4).
 		// Adjust first -> 1 to satisfy the upward respect distance of 2.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 2}, 6).Rets(1, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 2}, 6, 2).Rets(1, 0),
 		// selected = 6, oldFirst = 2 (likely because previous selected = 7).
 		// Adjust first -> 3 to satisfy the downward respect distance of 2.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 6, First: 2}, 6).Rets(3, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 6, First: 2}, 6, 2).Rets(3, 0),
 
 		// There is not enough budget to achieve respect distance on both sides.
 		// Split the budget in half.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 1}, 3).Rets(2, 0),
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 0}, 3).Rets(2, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 1}, 3, 2).Rets(2, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 3, First: 0}, 3, 2).Rets(2, 0),
 
 		// There is just enough distance to fit the selected item. Only show the
 		// selected item.
-		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 2, First: 0}, 1).Rets(2, 0),
+		Args(ListBoxState{Items: TestItems{NItems: 10}, Selected: 2, First: 0}, 1, 2).Rets(2, 0),
+
+		// A larger distance. selected = 6, oldFirst = 2: adjust first -> 3 to
+		// keep 3 rows below in a window of 7.
+		Args(ListBoxState{Items: TestItems{NItems: 12}, Selected: 6, First: 2}, 7, 3).Rets(3, 0),
+		// selected = 4, oldFirst = 3: adjust first -> 1 to keep 3 rows above.
+		Args(ListBoxState{Items: TestItems{NItems: 12}, Selected: 4, First: 3}, 7, 3).Rets(1, 0),
+		// No distance. selected = 6, oldFirst = 0: the selected item can be at
+		// the bottom edge, so first stays at 0.
+		Args(ListBoxState{Items: TestItems{NItems: 12}, Selected: 6, First: 0}, 7, 0).Rets(0, 0),
 	})
 }
 
@@ -95,6 +95,7 @@ func initLocation(ed *Editor, ev *eval.Evaler, st storedefs.Store, commonBinding
 	pinnedVar := newListVar(vals.EmptyList)
 	hiddenVar := newListVar(vals.EmptyList)
 	workspacesVar := newMapVar(vals.EmptyMap)
+	session := &modes.LocationSession{}
 
 	bindings := newMapBindings(ed, ev, bindingVar, commonBindingVar)
 	workspaceIterator := modes.LocationWSIterator(
@@ -108,15 +109,38 @@ func initLocation(ed *Editor, ev *eval.Evaler, st storedefs.Store, commonBinding
 				"pinned":     pinnedVar,
 				"workspaces": workspacesVar,
 			}).
-			AddGoFn("start", func() {
-				w, err := modes.NewLocation(ed.app, modes.LocationSpec{
-					Bindings: bindings, Store: dirStore{ev, st},
-					IteratePinned:     adaptToIterateString(pinnedVar),
-					IterateHidden:     adaptToIterateString(hiddenVar),
-					IterateWorkspaces: workspaceIterator,
-					Filter:            filterSpec,
-				})
-				startMode(ed.app, w, err)
+			AddGoFns(map[string]any{
+				"start": func() {
+					w, err := modes.NewLocation(ed.app, modes.LocationSpec{
+						Bindings: bindings, Store: dirStore{ev, st},
+						IteratePinned:     adaptToIterateString(pinnedVar),
+						IterateHidden:     adaptToIterateString(hiddenVar),
+						IterateWorkspaces: workspaceIterator,
+						Filter:            filterSpec,
+						Session:           session,
+					})
+					startMode(ed.app, w, err)
+				},
+				"jump-back":       actOnLocation(ed.app, modes.Location.JumpBack),
+				"accept-in-place": actOnLocation(ed.app, modes.Location.AcceptInPlace),
+				"toggle-absolute": actOnLocation(ed.app, modes.Location.ToggleAbsolute),
+				"delete":          actOnLocation(ed.app, modes.Location.Delete),
+				"toggle-sticky":   actOnLocation(ed.app, modes.Location.ToggleSticky),
+				"toggle-favorite": actOnLocation(ed.app, modes.Location.ToggleFavorite),
+				"toggle-column": func(name string) error {
+					c, err := modes.ParseLocationColumn(name)
+					if err != nil {
+						return err
+					}
+					if w, ok := activeLocation(ed.app); ok {
+						w.ToggleColumn(c)
+					}
+					return nil
+				},
+				"cycle-columns": actOnLocation(ed.app, modes.Location.CycleColumns),
+				"cycle-matcher": actOnLocation(ed.app, modes.Location.CycleMatcher),
+				"zoom-in":       actOnLocation(ed.app, modes.Location.ZoomIn),
+				"zoom-out":      actOnLocation(ed.app, modes.Location.ZoomOut),
 			}))
 	ev.AfterChdir = append(ev.AfterChdir, func(string) {
 		wd, err := os.Getwd()
@@ -125,10 +149,8 @@ func initLocation(ed *Editor, ev *eval.Evaler, st storedefs.Store, commonBinding
 			return
 		}
 		if st != nil {
-			st.AddDir(wd, 1)
-			kind, root := workspaceIterator.Parse(wd)
-			if kind != "" {
-				st.AddDir(kind+wd[len(root):], 1)
+			if err := modes.RecordChdir(st, workspaceIterator, wd); err != nil {
+				ed.notifyError("location", err)
 			}
 		}
 	})
@@ -267,6 +289,131 @@ func listingRefilter(app cli.App) {
 //
 // A map mapping types of workspaces to their patterns.
 
+//elvdoc:fn location:jump-back
+//
+// ```elvish
+// edit:location:jump-back
+// ```
+//
+// Changes to the directory most recently accepted in the location addon during
+// this session, skipping the current directory, and closes the addon. This can
+// be used to toggle between two directories.
+
+//elvdoc:fn location:accept-in-place
+//
+// ```elvish
+// edit:location:accept-in-place
+// ```
+//
+// Changes to the selected directory in the location addon without closing it.
+// The list is then updated for the new working directory, including the
+// workspace it belongs to.
+
+//elvdoc:fn location:toggle-absolute
+//
+// ```elvish
+// edit:location:toggle-absolute
+// ```
+//
+// Toggles whether the location addon shows paths without abbreviating the home
+// directory as `~`. Filtering always uses the abbreviated paths.
+
+//elvdoc:fn location:delete
+//
+// ```elvish
+// edit:location:delete
+// ```
+//
+// Deletes the selected directory in the location addon from the directory
+// history. If the directory is visited again later, it is added back.
+
+//elvdoc:fn location:toggle-sticky
+//
+// ```elvish
+// edit:location:toggle-sticky
+// ```
+//
+// Toggles whether the selected directory in the location addon is kept at the
+// top of the list, just below pinned directories. Unlike pinning, this is not
+// persisted and only lasts until the addon is closed.
+
+//elvdoc:fn location:toggle-favorite
+//
+// ```elvish
+// edit:location:toggle-favorite
+// ```
+//
+// Toggles whether the selected directory in the location addon is a favorite.
+// Favorite directories are marked with a star, and a filter containing `@fav`
+// only shows favorite directories. This requires support from the directory
+// history store, and does nothing otherwise.
+
+//elvdoc:fn location:toggle-column
+//
+// ```elvish
+// edit:location:toggle-column $name
+// ```
+//
+// Shows or hides a column between the score and the path of each directory in
+// the location addon. The name is one of `modtime`, `size` and `count` (the
+// number of subdirectories). A column that is shown this way becomes the last
+// column.
+
+//elvdoc:fn location:cycle-columns
+//
+// ```elvish
+// edit:location:cycle-columns
+// ```
+//
+// Rotates the columns shown in the location addon, so that the second column
+// becomes the first one.
+
+//elvdoc:fn location:cycle-matcher
+//
+// ```elvish
+// edit:location:cycle-matcher
+// ```
+//
+// Switches the location addon to the next matcher it has been configured with,
+// and filters the directories again. The name of the active matcher is shown
+// on the right of the filter. This does nothing if the location addon has no
+// matchers to cycle through.
+
+//elvdoc:fn location:zoom-in
+//
+// ```elvish
+// edit:location:zoom-in
+// ```
+//
+// Narrows the location addon to the directories under the selected directory,
+// showing their paths relative to it. The directories zoomed into are shown
+// in the prompt, and zooming can be nested.
+//
+// @cf edit:location:zoom-out
+
+//elvdoc:fn location:zoom-out
+//
+// ```elvish
+// edit:location:zoom-out
+// ```
+//
+// Undoes the last `edit:location:zoom-in`.
+//
+// @cf edit:location:zoom-in
+
+func activeLocation(app cli.App) (modes.Location, bool) {
+	w, ok := app.ActiveWidget().(modes.Location)
+	return w, ok
+}
+
+func actOnLocation(app cli.App, f func(modes.Location)) func() {
+	return func() {
+		if w, ok := activeLocation(app); ok {
+			f(w)
+		}
+	}
+}
+
 func adaptToIterateString(variable vars.Var) func(func(string)) {
 	return func(f func(s string)) {
 		vals.Iterate(variable.Get(), func(v any) bool {
@@ -316,6 +463,13 @@ func (d dirStore) Getwd() (string, error) {
 	return os.Getwd()
 }
 
+func (d dirStore) DelDir(dir string) error {
+	if d.st == nil {
+		return errStoreOffline
+	}
+	return d.st.DelDir(dir)
+}
+
 func startMode(app cli.App, w tk.Widget, err error) {
 	if w != nil {
 		app.PushAddon(w)
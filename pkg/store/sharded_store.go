@@ -0,0 +1,274 @@
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+	. "src.elv.sh/pkg/store/storedefs"
+)
+
+var errNoShards = errors.New("no shards")
+
+// A Store whose directory history is partitioned across several stores. The
+// command history and shared variables are kept in the first store.
+//
+// All the methods are implemented explicitly rather than by embedding the
+// first store, so that a method added to dbStore can't silently bypass the
+// sharding.
+type shardedStore struct {
+	shards []*dbStore
+}
+
+// NewShardedStore creates a Store from the given files, partitioning the
+// directory history across them. See NewShardedStoreFromDBs.
+func NewShardedStore(dbnames ...string) (DBStore, error) {
+	dbs := make([]*bolt.DB, len(dbnames))
+	for i, dbname := range dbnames {
+		db, err := dbWithDefaultOptions(dbname)
+		if err != nil {
+			for _, opened := range dbs[:i] {
+				opened.Close()
+			}
+			return nil, err
+		}
+		dbs[i] = db
+	}
+	st, err := NewShardedStoreFromDBs(dbs...)
+	if err != nil {
+		for _, db := range dbs {
+			db.Close()
+		}
+		return nil, err
+	}
+	return st, nil
+}
+
+// NewShardedStoreFromDBs creates a Store that partitions the directory history
+// across the given bolt DBs, by the hash of each path. This keeps each backing
+// file small for very large histories, and is transparent to users of the
+// Store: scores and blacklists work the same as with a single DB, up to
+// rounding. The command history and shared variables are kept in the first
+// DB.
+//
+// The same DBs must be passed in the same order every time, otherwise
+// directories are looked up in the wrong shards. If an error is returned, the
+// DBs are left open for the caller to close.
+func NewShardedStoreFromDBs(dbs ...*bolt.DB) (DBStore, error) {
+	if len(dbs) == 0 {
+		return nil, errNoShards
+	}
+	shards := make([]*dbStore, len(dbs))
+	for i, db := range dbs {
+		st, err := NewStoreFromDB(db)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucketDirShard))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = st.(*dbStore)
+	}
+	return &shardedStore{shards}, nil
+}
+
+// Returns the shard the directory belongs to. The whole path is hashed, since
+// most directories share their first few components, like /home/user.
+func (s *shardedStore) shard(d string) *dbStore {
+	h := fnv.New32a()
+	h.Write([]byte(d))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Decaying the scores of all the shards on every AddDir would take one
+// transaction, and thus one fsync, per shard, and a crash in between would
+// leave the shards decayed inconsistently. Instead, the first shard keeps a
+// clock counting the calls to AddDir, and each shard records the clock up to
+// which its scores have been decayed. AddDir only decays the shard it writes
+// to, and Dirs applies the pending decay of the other shards when reading.
+//
+// This takes at most two transactions per AddDir: one to advance the clock,
+// and one for the shard of the directory. A crash between them loses the visit,
+// but the decay of all the shards stays consistent. Since the pending decay is
+// applied in one step, scores may differ from those of a single DB in the last
+// stored digit.
+const (
+	bucketDirShard = "dir_shard"
+	keyClock       = "clock"
+	keyDecayed     = "decayed"
+)
+
+func getCount(b *bolt.Bucket, key string) uint64 {
+	n, _ := strconv.ParseUint(string(b.Get([]byte(key))), 10, 64)
+	return n
+}
+
+func putCount(b *bolt.Bucket, key string, n uint64) error {
+	return b.Put([]byte(key), []byte(strconv.FormatUint(n, 10)))
+}
+
+// Returns the current value of the clock.
+func (s *shardedStore) clock() (uint64, error) {
+	var clock uint64
+	err := s.shards[0].db.View(func(tx *bolt.Tx) error {
+		clock = getCount(tx.Bucket([]byte(bucketDirShard)), keyClock)
+		return nil
+	})
+	return clock, err
+}
+
+// Applies the decay pending in the transaction's shard up to the clock.
+func catchUpDecay(tx *bolt.Tx, clock uint64) error {
+	sb := tx.Bucket([]byte(bucketDirShard))
+	decayed := getCount(sb, keyDecayed)
+	if decayed >= clock {
+		return nil
+	}
+	b := tx.Bucket([]byte(bucketDir))
+	factor := math.Pow(DirScoreDecay, float64(clock-decayed))
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := b.Put(k, marshalScore(unmarshalScore(v)*factor)); err != nil {
+			return err
+		}
+	}
+	return putCount(sb, keyDecayed, clock)
+}
+
+// AddDir adds a directory to the directory history. Like with a single DB, the
+// scores of all the other directories decay, including those in other shards.
+func (s *shardedStore) AddDir(d string, incFactor float64) error {
+	target := s.shard(d)
+	add := func(tx *bolt.Tx, clock uint64) error {
+		if err := catchUpDecay(tx, clock); err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(bucketDir))
+		k := []byte(d)
+		score := float64(0)
+		if v := b.Get(k); v != nil {
+			score = unmarshalScore(v)
+		}
+		return b.Put(k, marshalScore(score+DirScoreIncrement*incFactor))
+	}
+	var clock uint64
+	err := s.shards[0].db.Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket([]byte(bucketDirShard))
+		clock = getCount(sb, keyClock) + 1
+		if err := putCount(sb, keyClock, clock); err != nil {
+			return err
+		}
+		if target == s.shards[0] {
+			return add(tx, clock)
+		}
+		return nil
+	})
+	if err != nil || target == s.shards[0] {
+		return err
+	}
+	return target.db.Update(func(tx *bolt.Tx) error { return add(tx, clock) })
+}
+
+// AddDirRaw adds a directory and its score to history.
+func (s *shardedStore) AddDirRaw(d string, score float64) error {
+	clock, err := s.clock()
+	if err != nil {
+		return err
+	}
+	return s.shard(d).db.Update(func(tx *bolt.Tx) error {
+		if err := catchUpDecay(tx, clock); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(bucketDir)).Put([]byte(d), marshalScore(score))
+	})
+}
+
+// DelDir deletes a directory record from history.
+func (s *shardedStore) DelDir(d string) error {
+	return s.shard(d).DelDir(d)
+}
+
+// Dirs lists all directories in the directory history of all the shards whose
+// names are not in the blacklist, with the pending decay applied. The results
+// are ordered by scores in descending order.
+func (s *shardedStore) Dirs(blacklist map[string]struct{}) ([]Dir, error) {
+	clock, err := s.clock()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []Dir
+	for _, shard := range s.shards {
+		err := shard.db.View(func(tx *bolt.Tx) error {
+			decayed := getCount(tx.Bucket([]byte(bucketDirShard)), keyDecayed)
+			factor := float64(1)
+			if decayed < clock {
+				factor = math.Pow(DirScoreDecay, float64(clock-decayed))
+			}
+			c := tx.Bucket([]byte(bucketDir)).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				d := string(k)
+				if _, ok := blacklist[d]; ok {
+					continue
+				}
+				// Round the same way as stored scores.
+				score := unmarshalScore(marshalScore(unmarshalScore(v) * factor))
+				dirs = append(dirs, Dir{Path: d, Score: score})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(sort.Reverse(dirList(dirs)))
+	return dirs, nil
+}
+
+func (s *shardedStore) NextCmdSeq() (int, error) { return s.shards[0].NextCmdSeq() }
+
+func (s *shardedStore) AddCmd(cmd string) (int, error) { return s.shards[0].AddCmd(cmd) }
+
+func (s *shardedStore) DelCmd(seq int) error { return s.shards[0].DelCmd(seq) }
+
+func (s *shardedStore) Cmd(seq int) (string, error) { return s.shards[0].Cmd(seq) }
+
+func (s *shardedStore) IterateCmds(from, upto int, f func(Cmd)) error {
+	return s.shards[0].IterateCmds(from, upto, f)
+}
+
+func (s *shardedStore) CmdsWithSeq(from, upto int) ([]Cmd, error) {
+	return s.shards[0].CmdsWithSeq(from, upto)
+}
+
+func (s *shardedStore) NextCmd(from int, prefix string) (Cmd, error) {
+	return s.shards[0].NextCmd(from, prefix)
+}
+
+func (s *shardedStore) PrevCmd(upto int, prefix string) (Cmd, error) {
+	return s.shards[0].PrevCmd(upto, prefix)
+}
+
+func (s *shardedStore) SharedVar(n string) (string, error) { return s.shards[0].SharedVar(n) }
+
+func (s *shardedStore) SetSharedVar(n, v string) error { return s.shards[0].SetSharedVar(n, v) }
+
+func (s *shardedStore) DelSharedVar(n string) error { return s.shards[0].DelSharedVar(n) }
+
+// Close waits for all outstanding operations to finish, and closes all the
+// shards. It returns the first error encountered.
+func (s *shardedStore) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,157 @@
+package store_test
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"src.elv.sh/pkg/store"
+	"src.elv.sh/pkg/store/storedefs"
+	"src.elv.sh/pkg/store/storetest"
+)
+
+func TestShardedStore(t *testing.T) {
+	storetest.TestCmd(t, store.MustTempShardedStore(t, 3))
+	storetest.TestDir(t, store.MustTempShardedStore(t, 3))
+	storetest.TestSharedVar(t, store.MustTempShardedStore(t, 3))
+}
+
+func TestShardedStore_SameAsSingleStore(t *testing.T) {
+	single := store.MustTempStore(t)
+	sharded := store.MustTempShardedStore(t, 4)
+
+	paths := []string{
+		"/usr", "/usr/bin", "/home/elf", "/home/elf/src", "/opt/a", "/tmp",
+		"/home/elf", "/var/log", "/usr", "/srv", "/home/elf", "/etc",
+	}
+	for i, path := range paths {
+		incFactor := float64(i%3 + 1)
+		for _, st := range []store.DBStore{single, sharded} {
+			if err := st.AddDir(path, incFactor); err != nil {
+				t.Fatalf("AddDir(%q) -> %v", path, err)
+			}
+		}
+	}
+	for _, st := range []store.DBStore{single, sharded} {
+		if err := st.DelDir("/tmp"); err != nil {
+			t.Fatalf("DelDir -> %v", err)
+		}
+	}
+
+	blacklist := map[string]struct{}{"/usr/bin": {}, "/etc": {}}
+	want, err := single.Dirs(blacklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sharded.Dirs(blacklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sharded store applies pending decay in one step, so scores may
+	// differ in the last stored digit.
+	if !sameDirs(got, want) {
+		t.Errorf("sharded store has dirs %v, want %v", got, want)
+	}
+}
+
+func sameDirs(a, b []storedefs.Dir) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path ||
+			math.Abs(a[i].Score-b[i].Score) > 1e-5*math.Abs(b[i].Score) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestShardedStore_DecaysOtherShards(t *testing.T) {
+	st := store.MustTempShardedStore(t, 4)
+	paths := make([]string, 20)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/home/elf/%d", i)
+		if err := st.AddDir(paths[i], 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The nth most recently added directory has been decayed n times since.
+	dirs, err := st.Dirs(storedefs.NoBlacklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]storedefs.Dir, len(paths))
+	for i := range want {
+		want[i] = storedefs.Dir{Path: paths[len(paths)-1-i],
+			Score: store.DirScoreIncrement * math.Pow(store.DirScoreDecay, float64(i))}
+	}
+	if !sameDirs(dirs, want) {
+		t.Errorf("got dirs %v, want %v", dirs, want)
+	}
+}
+
+func TestNewShardedStore(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewShardedStore(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestDir(t, st)
+	st.Close()
+
+	_, err = store.NewShardedStore()
+	if err == nil {
+		t.Errorf("NewShardedStore() -> no error")
+	}
+}
+
+func TestShardedStore_SpreadsDirsWithCommonPrefix(t *testing.T) {
+	dir := t.TempDir()
+	dbs := make([]*bolt.DB, 4)
+	for i := range dbs {
+		db, err := bolt.Open(filepath.Join(dir, fmt.Sprint(i)), 0644, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs[i] = db
+	}
+	st, err := store.NewShardedStoreFromDBs(dbs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for i := 0; i < 20; i++ {
+		if err := st.AddDir(fmt.Sprintf("/home/elf/%d", i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	used := 0
+	for _, db := range dbs {
+		shard, err := store.NewStoreFromDB(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dirs, _ := shard.Dirs(storedefs.NoBlacklist); len(dirs) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("directories under /home/elf are in %d shards, want at least 2", used)
+	}
+}
+
+func TestShardedStore_WrapsAllMethods(t *testing.T) {
+	single := reflect.TypeOf(store.MustTempStore(t))
+	sharded := reflect.TypeOf(store.MustTempShardedStore(t, 2))
+	for i := 0; i < single.NumMethod(); i++ {
+		name := single.Method(i).Name
+		if _, ok := sharded.MethodByName(name); !ok {
+			t.Errorf("sharded store doesn't implement %s", name)
+		}
+	}
+}
@@ -13,6 +13,32 @@ import (
 // Store and its underlying file will be cleaned up properly after the test is
 // finished.
 func MustTempStore(c testutil.Cleanuper) DBStore {
+	st, err := NewStoreFromDB(mustTempDB(c))
+	if err != nil {
+		panic(fmt.Sprintf("create Store instance: %v", err))
+	}
+	c.Cleanup(func() { st.Close() })
+	return st
+}
+
+// MustTempShardedStore is like MustTempStore, but returns a Store whose
+// directory history is partitioned across n temporary files.
+func MustTempShardedStore(c testutil.Cleanuper, n int) DBStore {
+	dbs := make([]*bolt.DB, n)
+	for i := range dbs {
+		dbs[i] = mustTempDB(c)
+	}
+	st, err := NewShardedStoreFromDBs(dbs...)
+	if err != nil {
+		panic(fmt.Sprintf("create Store instance: %v", err))
+	}
+	c.Cleanup(func() { st.Close() })
+	return st
+}
+
+// Returns a bolt DB backed by a temporary file, which is removed after the test
+// is finished. The DB must be closed by the caller.
+func mustTempDB(c testutil.Cleanuper) *bolt.DB {
 	f, err := os.CreateTemp("", "elvish.test")
 	if err != nil {
 		panic(fmt.Sprintf("open temp file: %v", err))
@@ -22,18 +48,12 @@ func MustTempStore(c testutil.Cleanuper) DBStore {
 	if err != nil {
 		panic(fmt.Sprintf("open boltdb: %v", err))
 	}
-
-	st, err := NewStoreFromDB(db)
-	if err != nil {
-		panic(fmt.Sprintf("create Store instance: %v", err))
-	}
 	c.Cleanup(func() {
-		st.Close()
 		f.Close()
 		err = os.Remove(f.Name())
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "failed to remove temp file:", err)
 		}
 	})
-	return st
+	return db
 }